@@ -0,0 +1,338 @@
+package gopcp_rpc
+
+import (
+	"context"
+	"errors"
+	"github.com/lock-free/gopcp"
+	"math/rand"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// client keeping connections to a set of backends, picks one backend per call.
+// Every backend is a reconnecting client, calls are only routed to healthy (connected) backends.
+// With circuit breaker, backends whose breaker is open are skipped as well.
+
+type Endpoint struct {
+	Host string `json:"host" yaml:"host"`
+	Port int    `json:"port" yaml:"port"`
+}
+
+func (e Endpoint) String() string {
+	return net.JoinHostPort(e.Host, strconv.Itoa(e.Port))
+}
+
+type BalanceStrategy int
+
+const (
+	BALANCE_ROUND_ROBIN BalanceStrategy = iota
+	BALANCE_LEAST_IN_FLIGHT
+	BALANCE_POWER_OF_TWO_CHOICES
+)
+
+var ErrNoHealthyBackend = errors.New("no healthy backend.")
+
+type BalancedClientOptions struct {
+	// options of connection to every backend, backends never buffer calls
+	ReconnectOptions
+	Strategy BalanceStrategy
+	// called when state of a backend changed
+	OnBackendStateChange func(endpoint Endpoint, from ConnState, to ConnState)
+	// circuit breaker per backend, nil to disable
+	Breaker *BreakerOptions
+	// retry policy, a retry may pick another backend, nil to disable
+	Retry *RetryPolicy
+	// hedging of idempotent functions, a hedged attempt picks another backend, nil to disable
+	Hedge *HedgePolicy
+}
+
+type backend struct {
+	endpoint Endpoint
+	client   *ReconnectingClient
+	breaker  *CircuitBreaker
+	inFlight int64 // calls routed to this backend
+}
+
+func (b *backend) closeWhenDrained() {
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+
+	for atomic.LoadInt64(&b.inFlight) > 0 {
+		<-ticker.C
+	}
+	b.client.Close()
+}
+
+func (b *backend) isHealthy() bool {
+	return b.client.State() == CONN_STATE_CONNECTED
+}
+
+// state of backend, for introspection
+type BackendState struct {
+	Endpoint Endpoint
+	State    ConnState
+	Healthy  bool
+	InFlight int
+	Breaker  BreakerState // BREAKER_CLOSED when circuit breaker is disabled
+}
+
+type BalancedClient struct {
+	generateSandbox GenerateSandbox
+	options         BalancedClientOptions
+
+	lock      sync.RWMutex
+	backends  []*backend
+	next      uint64 // round robin cursor
+	retrier   *retrier
+	stopWatch func()
+}
+
+func GetBalancedClient(endpoints []Endpoint, generateSandbox GenerateSandbox, options BalancedClientOptions) *BalancedClient {
+	options.BufferCalls = false
+	b := &BalancedClient{generateSandbox: generateSandbox, options: options, retrier: newRetrier(options.Retry)}
+	b.UpdateEndpoints(endpoints)
+	return b
+}
+
+// backends follow endpoint changes of resolver
+func GetBalancedClientFromResolver(resolver Resolver, generateSandbox GenerateSandbox, options BalancedClientOptions) (*BalancedClient, error) {
+	endpoints, err := resolver.Resolve()
+	if err != nil {
+		return nil, err
+	}
+	b := GetBalancedClient(endpoints, generateSandbox, options)
+	b.stopWatch = resolver.Watch(endpoints, b.UpdateEndpoints)
+	return b, nil
+}
+
+func (b *BalancedClient) newBackend(endpoint Endpoint) *backend {
+	options := b.options.ReconnectOptions
+	onStateChange := options.OnStateChange
+	options.OnStateChange = func(from ConnState, to ConnState) {
+		if onStateChange != nil {
+			onStateChange(from, to)
+		}
+		if b.options.OnBackendStateChange != nil {
+			b.options.OnBackendStateChange(endpoint, from, to)
+		}
+	}
+
+	var breaker *CircuitBreaker
+	if b.options.Breaker != nil {
+		breaker = GetCircuitBreaker(*b.options.Breaker)
+	}
+
+	return &backend{
+		endpoint: endpoint,
+		breaker:  breaker,
+		client: GetReconnectingClient(func() (string, int, error) {
+			return endpoint.Host, endpoint.Port, nil
+		}, b.generateSandbox, options),
+	}
+}
+
+// connect new endpoints and close backends which are not in endpoints any more, duplicated endpoints share one backend
+func (b *BalancedClient) UpdateEndpoints(endpoints []Endpoint) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	current := map[Endpoint]*backend{}
+	for _, backend := range b.backends {
+		current[backend.endpoint] = backend
+	}
+
+	var backends []*backend
+	seen := map[Endpoint]bool{}
+	for _, endpoint := range endpoints {
+		if seen[endpoint] {
+			continue
+		}
+		seen[endpoint] = true
+
+		if backend, ok := current[endpoint]; ok {
+			backends = append(backends, backend)
+			delete(current, endpoint)
+		} else {
+			backends = append(backends, b.newBackend(endpoint))
+		}
+	}
+
+	// removed backends do not get new calls, close them after in-flight calls finished
+	for _, backend := range current {
+		go backend.closeWhenDrained()
+	}
+	b.backends = backends
+}
+
+func (b *BalancedClient) Backends() []BackendState {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	var states []BackendState
+	for _, backend := range b.backends {
+		state := backend.client.State()
+		breakerState := BREAKER_CLOSED
+		if backend.breaker != nil {
+			breakerState = backend.breaker.State()
+		}
+		states = append(states, BackendState{
+			Endpoint: backend.endpoint,
+			State:    state,
+			Healthy:  state == CONN_STATE_CONNECTED,
+			InFlight: int(atomic.LoadInt64(&backend.inFlight)),
+			Breaker:  breakerState,
+		})
+	}
+	return states
+}
+
+func (b *BalancedClient) healthyBackends() []*backend {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	var healthy []*backend
+	for _, backend := range b.backends {
+		if backend.isHealthy() {
+			healthy = append(healthy, backend)
+		}
+	}
+	return healthy
+}
+
+// backends in used are skipped unless all healthy backends are used
+func (b *BalancedClient) pick(used map[*backend]bool) (*backend, error) {
+	healthy := b.healthyBackends()
+	if len(healthy) == 0 {
+		return nil, ErrNoHealthyBackend
+	}
+
+	var unused []*backend
+	for _, backend := range healthy {
+		if !used[backend] {
+			unused = append(unused, backend)
+		}
+	}
+	if len(unused) > 0 {
+		healthy = unused
+	}
+
+	if b.options.Breaker != nil {
+		var ready []*backend
+		for _, backend := range healthy {
+			if backend.breaker.Ready() {
+				ready = append(ready, backend)
+			}
+		}
+		if len(ready) == 0 {
+			return nil, ErrCircuitOpen
+		}
+		healthy = ready
+	}
+
+	switch b.options.Strategy {
+	case BALANCE_LEAST_IN_FLIGHT:
+		// scan from the round robin cursor, so ties are taken in turn
+		start := int((atomic.AddUint64(&b.next, 1) - 1) % uint64(len(healthy)))
+		picked := healthy[start]
+		for i := 1; i < len(healthy); i++ {
+			backend := healthy[(start+i)%len(healthy)]
+			if atomic.LoadInt64(&backend.inFlight) < atomic.LoadInt64(&picked.inFlight) {
+				picked = backend
+			}
+		}
+		return picked, nil
+
+	case BALANCE_POWER_OF_TWO_CHOICES:
+		if len(healthy) == 1 {
+			return healthy[0], nil
+		}
+		i := rand.Intn(len(healthy))
+		j := rand.Intn(len(healthy) - 1)
+		if j >= i {
+			j++
+		}
+		if atomic.LoadInt64(&healthy[j].inFlight) < atomic.LoadInt64(&healthy[i].inFlight) {
+			return healthy[j], nil
+		}
+		return healthy[i], nil
+
+	default:
+		n := atomic.AddUint64(&b.next, 1)
+		return healthy[int((n-1)%uint64(len(healthy)))], nil
+	}
+}
+
+func (b *BalancedClient) CallRemote(command string, timeout time.Duration) (interface{}, error) {
+	return b.CallRemoteContext(context.Background(), command, timeout)
+}
+
+func (b *BalancedClient) CallRemoteContext(ctx context.Context, command string, timeout time.Duration) (interface{}, error) {
+	return b.retrier.call(command, func() (interface{}, error) {
+		var lock sync.Mutex
+		used := map[*backend]bool{}
+
+		return hedge(ctx, b.options.Hedge, command, func(ctx context.Context, n int) (interface{}, error) {
+			lock.Lock()
+			backend, err := b.pick(used)
+			if err == nil {
+				used[backend] = true
+			}
+			lock.Unlock()
+
+			if err != nil {
+				return nil, err
+			}
+			return b.callBackend(ctx, backend, command, timeout)
+		})
+	})
+}
+
+func (b *BalancedClient) callBackend(ctx context.Context, backend *backend, command string, timeout time.Duration) (interface{}, error) {
+	atomic.AddInt64(&backend.inFlight, 1)
+	defer atomic.AddInt64(&backend.inFlight, -1)
+
+	if backend.breaker == nil {
+		return backend.client.CallRemoteContext(ctx, command, timeout)
+	}
+	done, err := backend.breaker.Allow()
+	if err != nil {
+		return nil, err
+	}
+	ret, err := backend.client.CallRemoteContext(ctx, command, timeout)
+	done(err)
+	return ret, err
+}
+
+func (b *BalancedClient) Call(list gopcp.CallResult, timeout time.Duration) (interface{}, error) {
+	return b.CallContext(context.Background(), list, timeout)
+}
+
+func (b *BalancedClient) CallContext(ctx context.Context, list gopcp.CallResult, timeout time.Duration) (interface{}, error) {
+	pcpClient := gopcp.PcpClient{}
+	if cmdText, err := pcpClient.ToJSON(list); err != nil {
+		return nil, err
+	} else {
+		return b.CallRemoteContext(ctx, cmdText, timeout)
+	}
+}
+
+func (b *BalancedClient) RetryStats() RetryStats {
+	return b.retrier.Stats()
+}
+
+func (b *BalancedClient) Close() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.stopWatch != nil {
+		b.stopWatch()
+	}
+
+	for _, backend := range b.backends {
+		backend.client.Close()
+	}
+	b.backends = nil
+}
@@ -0,0 +1,157 @@
+package gopcp_rpc
+
+import (
+	"context"
+	"github.com/lock-free/gopcp"
+	"github.com/lock-free/gopcp_stream"
+	"testing"
+	"time"
+)
+
+// sandbox telling which server handles the call
+func namedSandbox(name string) GenerateSandbox {
+	return func(streamServer *gopcp_stream.StreamServer) *gopcp.Sandbox {
+		return gopcp.GetSandbox(map[string]*gopcp.BoxFunc{
+			"name": gopcp.ToSandboxFun(func(args []interface{}, attachment interface{}, pcpServer *gopcp.PcpServer) (interface{}, error) {
+				return name, nil
+			}),
+			"sleep": gopcp.ToSandboxFun(func(args []interface{}, attachment interface{}, pcpServer *gopcp.PcpServer) (interface{}, error) {
+				time.Sleep(time.Duration(args[0].(float64)) * time.Millisecond)
+				return name, nil
+			}),
+		})
+	}
+}
+
+func testBalancedServers(t *testing.T, names ...string) ([]*PCPRPCServer, []Endpoint) {
+	var servers []*PCPRPCServer
+	var endpoints []Endpoint
+	for _, name := range names {
+		server, err := GetPCPRPCServer(0, namedSandbox(name), nil)
+		if err != nil {
+			t.Fatalf("fail to start server, %v", err)
+		}
+		servers = append(servers, server)
+		endpoints = append(endpoints, Endpoint{"127.0.0.1", server.GetPort()})
+	}
+	return servers, endpoints
+}
+
+func waitHealthy(t *testing.T, client *BalancedClient, count int) {
+	for i := 0; i < 100; i++ {
+		if len(client.healthyBackends()) == count {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("expect %d healthy backends, but got %d", count, len(client.healthyBackends()))
+}
+
+func TestBalancedClientRoundRobin(t *testing.T) {
+	servers, endpoints := testBalancedServers(t, "a", "b")
+	defer servers[0].Close()
+	defer servers[1].Close()
+
+	client := GetBalancedClient(endpoints, simpleSandbox, BalancedClientOptions{})
+	defer client.Close()
+	waitHealthy(t, client, 2)
+
+	counts := map[interface{}]int{}
+	for i := 0; i < 10; i++ {
+		ret, err := client.CallRemote(`["name"]`, time.Second)
+		assertEqual(t, err, nil, "")
+		counts[ret]++
+	}
+	assertEqual(t, counts["a"], 5, "")
+	assertEqual(t, counts["b"], 5, "")
+
+	// unhealthy backend is skipped
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	servers[0].Shutdown(ctx)
+	waitHealthy(t, client, 1)
+	for i := 0; i < 4; i++ {
+		ret, err := client.CallRemote(`["name"]`, time.Second)
+		assertEqual(t, err, nil, "")
+		assertEqual(t, ret, "b", "")
+	}
+}
+
+func TestBalancedClientLeastInFlight(t *testing.T) {
+	for _, strategy := range []BalanceStrategy{BALANCE_LEAST_IN_FLIGHT, BALANCE_POWER_OF_TWO_CHOICES} {
+		servers, endpoints := testBalancedServers(t, "a", "b")
+
+		client := GetBalancedClient(endpoints, simpleSandbox, BalancedClientOptions{Strategy: strategy})
+		waitHealthy(t, client, 2)
+
+		// occupy one backend
+		done := make(chan struct{})
+		go func() {
+			client.CallRemote(`["sleep", 200]`, time.Second)
+			close(done)
+		}()
+		time.Sleep(20 * time.Millisecond)
+
+		var busy Endpoint
+		for _, state := range client.Backends() {
+			if state.InFlight == 1 {
+				busy = state.Endpoint
+			}
+		}
+		busyName := "a"
+		if busy == endpoints[1] {
+			busyName = "b"
+		}
+
+		for i := 0; i < 5; i++ {
+			ret, err := client.CallRemote(`["name"]`, time.Second)
+			assertEqual(t, err, nil, "")
+			if ret == busyName {
+				t.Errorf("call should be routed to the idle backend, strategy=%d", strategy)
+			}
+		}
+
+		<-done
+		for _, state := range client.Backends() {
+			assertEqual(t, state.InFlight, 0, "")
+		}
+
+		client.Close()
+		servers[0].Close()
+		servers[1].Close()
+	}
+}
+
+func TestBalancedClientLeastInFlightTie(t *testing.T) {
+	servers, endpoints := testBalancedServers(t, "a", "b")
+	defer servers[0].Close()
+	defer servers[1].Close()
+
+	client := GetBalancedClient(endpoints, simpleSandbox, BalancedClientOptions{Strategy: BALANCE_LEAST_IN_FLIGHT})
+	defer client.Close()
+	waitHealthy(t, client, 2)
+
+	// sequential calls, every backend is idle, ties are taken in turn
+	counts := map[interface{}]int{}
+	for i := 0; i < 10; i++ {
+		ret, err := client.CallRemote(`["name"]`, time.Second)
+		assertEqual(t, err, nil, "")
+		counts[ret]++
+	}
+	assertEqual(t, counts["a"], 5, "")
+	assertEqual(t, counts["b"], 5, "")
+}
+
+func TestBalancedClientDuplicatedEndpoints(t *testing.T) {
+	servers, endpoints := testBalancedServers(t, "a", "b")
+	defer servers[0].Close()
+	defer servers[1].Close()
+
+	client := GetBalancedClient([]Endpoint{endpoints[0], endpoints[0], endpoints[1]}, simpleSandbox, BalancedClientOptions{})
+	defer client.Close()
+	assertEqual(t, len(client.Backends()), 2, "")
+
+	client.UpdateEndpoints([]Endpoint{endpoints[1], endpoints[1]})
+	assertEqual(t, len(client.Backends()), 1, "")
+	assertEqual(t, client.Backends()[0].Endpoint, endpoints[1], "")
+}
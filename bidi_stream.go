@@ -0,0 +1,238 @@
+package gopcp_rpc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/lock-free/gopcp"
+	"github.com/lock-free/gopcp_stream"
+	"io"
+	"math"
+	"strings"
+	"sync"
+	"time"
+)
+
+// bidirectional stream
+// caller and handler both send items over the same logical stream id.
+// caller -> handler chunks are sent by "__bidi_accept", handler -> caller chunks by "__stream_accept".
+// each side closes its sending direction by CloseSend (half-close), and keeps receiving from C.
+// eg:
+//   stream, err := client.BidiStream(ctx, time.Minute, "chat", "room1")
+//   stream.Send("hello", time.Second)
+//   stream.CloseSend(time.Second)
+//   for item := range stream.C {}
+
+const DEFAULT_STREAM_CLOSE_TIMEOUT = 10 * time.Second
+
+var ErrStreamSendClosed = errors.New("sending direction of stream is closed.")
+var ErrBidiStreamNotFound = errors.New("bidirectional stream is not found, handler may be finished.")
+
+type BidiStream struct {
+	// items received from the other side
+	*Stream
+
+	id         string
+	p          *PCPConnectionHandler
+	acceptName string
+
+	sendLock   sync.Mutex // keeps chunks of this side in order
+	sendClosed bool
+}
+
+func newBidiStream(stream *Stream, id string, p *PCPConnectionHandler, acceptName string) *BidiStream {
+	return &BidiStream{Stream: stream, id: id, p: p, acceptName: acceptName}
+}
+
+func (b *BidiStream) Id() string {
+	return b.id
+}
+
+// send an item to the other side, blocks when stream window of the other side is full
+func (b *BidiStream) Send(d interface{}, timeout time.Duration) error {
+	return b.sendChunk(gopcp_stream.STREAM_DATA, d, timeout)
+}
+
+// close sending direction, items from the other side are still received
+func (b *BidiStream) CloseSend(timeout time.Duration) error {
+	return b.sendChunk(gopcp_stream.STREAM_END, 0, timeout)
+}
+
+// close sending direction with an error, which is the Err() of the other side
+func (b *BidiStream) CloseSendWithError(errMsg string, timeout time.Duration) error {
+	return b.sendChunk(gopcp_stream.STREAM_ERROR, errMsg, timeout)
+}
+
+func (b *BidiStream) sendChunk(t int, d interface{}, timeout time.Duration) error {
+	b.sendLock.Lock()
+	defer b.sendLock.Unlock()
+
+	if b.sendClosed {
+		return ErrStreamSendClosed
+	}
+	if t != gopcp_stream.STREAM_DATA {
+		b.sendClosed = true
+	}
+
+	cmdText, err := b.p.PcpClient.ToJSON(b.p.PcpClient.Call(b.acceptName, b.id, t, d))
+	if err != nil {
+		return err
+	}
+	_, err = b.p.sendStreamChunk(cmdText, timeout)
+	if callErr, ok := err.(*CallError); ok && callErr.ErrMsg == ErrBidiStreamNotFound.Error() {
+		// handler at the other side is finished, nobody receives chunks any more
+		b.sendClosed = true
+		b.p.streamCredits.Delete(b.id)
+		return ErrStreamSendClosed
+	}
+	return err
+}
+
+// call a bidirectional stream function, defined by BidiStreamApi at remote.
+// C is closed when remote ended its sending direction, failed or ctx is done.
+func (p *PCPConnectionHandler) BidiStream(ctx context.Context, timeout time.Duration, streamFunName string, params ...interface{}) (*BidiStream, error) {
+	stream, id, err := p.startStream(ctx, timeout, streamFunName, params, nil)
+	if err != nil {
+		return nil, err
+	}
+	return newBidiStream(stream, id, p, BIDI_ACCEPT_NAME), nil
+}
+
+// inbox of a bidirectional stream at handler side, created by the handler
+func (p *PCPConnectionHandler) getBidiInbox(sid string) *Stream {
+	inbox, _ := p.bidiInboxes.LoadOrStore(sid, newStream())
+	return inbox.(*Stream)
+}
+
+// inbox for a chunk of caller. Chunks may arrive before the handler started, then inbox is created
+// while the request of handler is not finished. After that, stream is unknown.
+func (p *PCPConnectionHandler) acceptBidiInbox(sid string) (*Stream, bool) {
+	if inbox, ok := p.bidiInboxes.Load(sid); ok {
+		return inbox.(*Stream), true
+	}
+
+	p.streamLock.Lock()
+	defer p.streamLock.Unlock()
+	if _, ok := p.streamRequests.Load(sid); !ok {
+		return nil, false
+	}
+	return p.getBidiInbox(sid), true
+}
+
+// stream id of a request, which is the last param when it is a string, eg: ["chat", "room1", "sid"].
+// cancel of a stream carries its id too, but it is not the stream request.
+func getRequestStreamId(cmd *CommandPkt) (string, bool) {
+	text, ok := cmd.Data.Text.(string)
+	if !ok || !strings.HasSuffix(text, `"]`) || strings.HasPrefix(text, `["`+STREAM_CANCEL_NAME+`"`) {
+		return "", false
+	}
+	var list []json.RawMessage
+	if err := json.Unmarshal([]byte(text), &list); err != nil || len(list) < 2 {
+		return "", false
+	}
+	var sid string
+	if err := json.Unmarshal(list[len(list)-1], &sid); err != nil {
+		return "", false
+	}
+	return sid, true
+}
+
+// request carrying stream id is finished, streams of it are removed even handler never started
+func (p *PCPConnectionHandler) finishStreamRequest(sid string) {
+	p.streamLock.Lock()
+	defer p.streamLock.Unlock()
+	p.streamRequests.Delete(sid)
+	p.canceledStreams.Delete(sid)
+	if inbox, ok := p.bidiInboxes.LoadAndDelete(sid); ok {
+		inbox.(*Stream).finish(nil)
+	}
+	if stream, ok := p.binaryStreams.LoadAndDelete(sid); ok {
+		stream.(*BinaryStream).terminate(io.EOF)
+	}
+}
+
+// define bidirectional stream function, handle receives items of caller from stream.C and sends items by stream.Send.
+// sending direction is closed after handle returned, with error message when handle failed.
+func BidiStreamApi(handle func(*BidiStream, []interface{}, interface{}, *gopcp.PcpServer) (interface{}, error)) *gopcp.BoxFunc {
+	// (...args, streamId)
+	return gopcp.ToSandboxFun(func(args []interface{}, attachment interface{}, pcpServer *gopcp.PcpServer) (interface{}, error) {
+		if len(args) < 1 {
+			return nil, errors.New("missing stream id at the stream request")
+		}
+		sid, ok := args[len(args)-1].(string)
+		if !ok {
+			return nil, errors.New("missing stream id (string) at the stream request")
+		}
+		p, ok := getConnectionHandler(attachment)
+		if !ok {
+			return nil, errors.New("bidirectional stream is only supported over pcp connection.")
+		}
+
+		inbox := p.getBidiInbox(sid)
+		defer p.finishStreamRequest(sid)
+
+		// stop receiving when request is canceled or connection is closed
+		ctx := GetContext(attachment)
+		go func() {
+			select {
+			case <-ctx.Done():
+				inbox.finish(ctx.Err())
+			case <-inbox.done:
+			}
+		}()
+
+		stream := newBidiStream(inbox, sid, p, STREAM_ACCEPT_NAME)
+		ret, err := handle(stream, args[:len(args)-1], attachment, pcpServer)
+
+		var closeErr error
+		if err != nil {
+			closeErr = stream.CloseSendWithError(err.Error(), DEFAULT_STREAM_CLOSE_TIMEOUT)
+		} else {
+			closeErr = stream.CloseSend(DEFAULT_STREAM_CLOSE_TIMEOUT)
+		}
+		if closeErr != nil && closeErr != ErrStreamSendClosed && err == nil {
+			err = closeErr
+		}
+		inbox.finish(nil)
+
+		return ret, err
+	})
+}
+
+func getConnectionHandler(attachment interface{}) (*PCPConnectionHandler, bool) {
+	if m, ok := attachment.(map[string]interface{}); ok {
+		p, ok := m["pch"].(*PCPConnectionHandler)
+		return p, ok
+	}
+	return nil, false
+}
+
+// accept chunks sent by caller of bidirectional stream
+// args = [streamId: string, t: int, d: interface{}]
+func getBidiAcceptBoxFun() *gopcp.BoxFunc {
+	return gopcp.ToSandboxFun(func(args []interface{}, attachment interface{}, pcpServer *gopcp.PcpServer) (interface{}, error) {
+		if len(args) < 3 {
+			return nil, errors.New("stream chunk format: [streamId: string, t: int, d: interface{}].")
+		}
+		sid, ok := args[0].(string)
+		if !ok {
+			return nil, errors.New("stream chunk format: [streamId: string, t: int, d: interface{}].")
+		}
+		t, ok := args[1].(float64)
+		if !ok {
+			return nil, errors.New("stream chunk format: [streamId: string, t: int, d: interface{}].")
+		}
+		p, ok := getConnectionHandler(attachment)
+		if !ok {
+			return nil, errors.New("bidirectional stream is only supported over pcp connection.")
+		}
+
+		// inbox is removed when the request of handler finished
+		inbox, ok := p.acceptBidiInbox(sid)
+		if !ok {
+			return nil, ErrBidiStreamNotFound
+		}
+		inbox.accept(int(math.Trunc(t)), args[2])
+		return nil, nil
+	})
+}
@@ -0,0 +1,146 @@
+package gopcp_rpc
+
+import (
+	"context"
+	"errors"
+	"github.com/lock-free/gopcp"
+	"github.com/lock-free/gopcp_stream"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// echo doubles every item, sum replies the sum after caller closed sending, reject fails after first item
+func bidiSandbox(streamServer *gopcp_stream.StreamServer) *gopcp.Sandbox {
+	return gopcp.GetSandbox(map[string]*gopcp.BoxFunc{
+		"echo": BidiStreamApi(func(stream *BidiStream, args []interface{}, attachment interface{}, pcpServer *gopcp.PcpServer) (interface{}, error) {
+			for item := range stream.C {
+				if err := stream.Send(item.(float64)*2, 10*time.Second); err != nil {
+					return nil, err
+				}
+			}
+			return nil, stream.Err()
+		}),
+		"sum": BidiStreamApi(func(stream *BidiStream, args []interface{}, attachment interface{}, pcpServer *gopcp.PcpServer) (interface{}, error) {
+			sum := 0.0
+			for item := range stream.C {
+				sum += item.(float64)
+			}
+			return nil, stream.Send(sum, 10*time.Second)
+		}),
+		"reject": BidiStreamApi(func(stream *BidiStream, args []interface{}, attachment interface{}, pcpServer *gopcp.PcpServer) (interface{}, error) {
+			<-stream.C
+			return nil, errors.New("rejected")
+		}),
+	})
+}
+
+func testBidiClient(t *testing.T, options ConnectionOptions) (*PCPRPCServer, *PCPConnectionHandler) {
+	server, err := GetPCPRPCServerWithOptions(0, bidiSandbox, nil, ServerOptions{ConnectionOptions: options})
+	if err != nil {
+		t.Fatalf("fail to start server, %v", err)
+	}
+	client, err := GetPCPRPCClientWithOptions("127.0.0.1", server.GetPort(), simpleSandbox, nil, options)
+	if err != nil {
+		t.Fatalf("fail to connect, %v", err)
+	}
+	return server, client
+}
+
+func TestBidiStreamEcho(t *testing.T) {
+	for _, window := range []int{0, 4} {
+		server, client := testBidiClient(t, ConnectionOptions{StreamWindow: window})
+
+		stream, err := client.BidiStream(context.Background(), 10*time.Second, "echo")
+		assertEqual(t, err, nil, "")
+		go func() {
+			for i := 1; i <= 5; i++ {
+				stream.Send(i, 10*time.Second)
+			}
+			stream.CloseSend(10 * time.Second)
+		}()
+
+		items := []float64{}
+		for item := range stream.C {
+			items = append(items, item.(float64))
+		}
+		assertEqual(t, stream.Err(), nil, "")
+		assertEqual(t, len(items), 5, "")
+		for i, item := range items {
+			assertEqual(t, item, float64(i+1)*2, "")
+		}
+		assertEqual(t, stream.Send(6, time.Second), ErrStreamSendClosed, "")
+
+		client.Close()
+		server.Close()
+	}
+}
+
+func TestBidiStreamHalfClose(t *testing.T) {
+	server, client := testBidiClient(t, ConnectionOptions{})
+	defer server.Close()
+	defer client.Close()
+
+	stream, err := client.BidiStream(context.Background(), 10*time.Second, "sum")
+	assertEqual(t, err, nil, "")
+	for i := 1; i <= 10; i++ {
+		assertEqual(t, stream.Send(i, 10*time.Second), nil, "")
+	}
+	assertEqual(t, stream.CloseSend(10*time.Second), nil, "")
+
+	assertEqual(t, <-stream.C, 55.0, "")
+	_, ok := <-stream.C
+	assertEqual(t, ok, false, "")
+	assertEqual(t, stream.Err(), nil, "")
+}
+
+func TestBidiStreamHandlerError(t *testing.T) {
+	server, client := testBidiClient(t, ConnectionOptions{})
+	defer server.Close()
+	defer client.Close()
+
+	stream, err := client.BidiStream(context.Background(), 10*time.Second, "reject")
+	assertEqual(t, err, nil, "")
+	assertEqual(t, stream.Send(1, 10*time.Second), nil, "")
+
+	for range stream.C {
+	}
+	assertEqual(t, stream.Err().Error(), "rejected", "")
+}
+
+func TestBidiStreamSendAfterHandlerFinished(t *testing.T) {
+	for _, window := range []int{0, 4} {
+		server, client := testBidiClient(t, ConnectionOptions{StreamWindow: window})
+
+		stream, err := client.BidiStream(context.Background(), 10*time.Second, "reject")
+		assertEqual(t, err, nil, "")
+		assertEqual(t, stream.Send(1, 10*time.Second), nil, "")
+		for range stream.C {
+		}
+
+		// handler is finished, sends fail instead of filling an inbox nobody reads
+		for i := 0; ; i++ {
+			if i > 20 {
+				t.Fatal("expect sending direction closed")
+			}
+			if err := stream.Send(i, time.Second); err != nil {
+				assertEqual(t, err, ErrStreamSendClosed, "")
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		pch := server.Connections()[0]
+		for i := 0; atomic.LoadInt64(&pch.remoteInFlight) != 0; i++ {
+			if i > 100 {
+				t.Fatal("expect no request in flight")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		_, ok := pch.bidiInboxes.Load(stream.Id())
+		assertEqual(t, ok, false, "")
+
+		client.Close()
+		server.Close()
+	}
+}
@@ -0,0 +1,349 @@
+package gopcp_rpc
+
+import (
+	"context"
+	"errors"
+	"github.com/lock-free/gopcp"
+	"github.com/lock-free/gopcp_stream"
+	"github.com/satori/go.uuid"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// binary stream
+// raw bytes are sent by binary chunk packages instead of json pcp calls, in both directions over the same stream id.
+// every chunk is acked by a binary ack package after reader took it, writer blocks when DEFAULT_BINARY_WINDOW chunks are not acked.
+// eg:
+//   stream, err := client.BinaryStream(ctx, time.Minute, "upload", "a.txt")
+//   io.Copy(stream, file)
+//   stream.CloseWrite()
+//   ioutil.ReadAll(stream)
+
+const DEFAULT_BINARY_CHUNK_SIZE = 32 * 1024
+const DEFAULT_BINARY_WINDOW = 16
+
+var ErrBinaryWindowExceeded = errors.New("remote sent more binary chunks than window of stream.")
+
+type BinaryStream struct {
+	id string
+	p  *PCPConnectionHandler
+
+	lock    sync.Mutex
+	chunks  [][]byte // received chunks, not read yet
+	pending []byte   // rest of the chunk being read
+	readErr error    // io.EOF after remote ended writing
+	signal  chan struct{}
+
+	writeLock   sync.Mutex
+	writeClosed bool
+	credits     chan struct{} // chunks sent without ack
+
+	once     sync.Once
+	done     chan struct{}
+	closeErr error
+}
+
+func newBinaryStream(id string, p *PCPConnectionHandler) *BinaryStream {
+	return &BinaryStream{
+		id:      id,
+		p:       p,
+		signal:  make(chan struct{}, 1),
+		credits: make(chan struct{}, DEFAULT_BINARY_WINDOW),
+		done:    make(chan struct{}),
+	}
+}
+
+func (b *BinaryStream) Id() string {
+	return b.id
+}
+
+// reads bytes written by remote, returns io.EOF after remote closed writing
+func (b *BinaryStream) Read(data []byte) (int, error) {
+	for {
+		b.lock.Lock()
+		if len(b.pending) == 0 && len(b.chunks) > 0 {
+			b.pending = b.chunks[0]
+			b.chunks = b.chunks[1:]
+			b.lock.Unlock()
+			// chunk is taken, return the credit. Without it remote can not write any more,
+			// chunks received are still readable, then the error is returned
+			if err := b.p.packageProtocol.SendPkt(b.p.ConnHandler, BinaryAckToPkt(b.id)); err != nil {
+				b.terminate(err)
+			}
+			continue
+		}
+		if len(b.pending) > 0 {
+			n := copy(data, b.pending)
+			b.pending = b.pending[n:]
+			b.lock.Unlock()
+			return n, nil
+		}
+		if b.readErr != nil {
+			err := b.readErr
+			b.lock.Unlock()
+			return 0, err
+		}
+		b.lock.Unlock()
+
+		<-b.signal
+	}
+}
+
+// writes bytes to remote in chunks, blocks when remote is slow
+func (b *BinaryStream) Write(data []byte) (int, error) {
+	b.writeLock.Lock()
+	defer b.writeLock.Unlock()
+
+	written := 0
+	for written < len(data) {
+		end := written + DEFAULT_BINARY_CHUNK_SIZE
+		if end > len(data) {
+			end = len(data)
+		}
+		if err := b.sendChunk(gopcp_stream.STREAM_DATA, data[written:end]); err != nil {
+			return written, err
+		}
+		written = end
+	}
+	return written, nil
+}
+
+// close writing, remote reads io.EOF after bytes written before
+func (b *BinaryStream) CloseWrite() error {
+	b.writeLock.Lock()
+	defer b.writeLock.Unlock()
+	return b.sendChunk(gopcp_stream.STREAM_END, nil)
+}
+
+// close writing with an error, which is returned by Read of remote
+func (b *BinaryStream) CloseWriteWithError(errMsg string) error {
+	b.writeLock.Lock()
+	defer b.writeLock.Unlock()
+	return b.sendChunk(gopcp_stream.STREAM_ERROR, []byte(errMsg))
+}
+
+// should hold writeLock
+func (b *BinaryStream) sendChunk(t int, data []byte) error {
+	if b.writeClosed {
+		return ErrStreamSendClosed
+	}
+	pkt, err := BinaryChunkToPkt(b.id, t, data)
+	if err != nil {
+		return err
+	}
+
+	if t == gopcp_stream.STREAM_DATA {
+		select {
+		case b.credits <- struct{}{}:
+		case <-b.done:
+			if b.closeErr == io.EOF {
+				return ErrStreamSendClosed
+			}
+			return b.closeErr
+		}
+	} else {
+		b.writeClosed = true
+	}
+
+	return b.p.packageProtocol.SendPkt(b.p.ConnHandler, pkt)
+}
+
+func (b *BinaryStream) accept(t int, data []byte) {
+	switch t {
+	case gopcp_stream.STREAM_DATA:
+		if len(data) == 0 {
+			return
+		}
+		select {
+		case <-b.done:
+			// terminated, nobody waits for more chunks
+			return
+		default:
+		}
+		b.lock.Lock()
+		if len(b.chunks) >= DEFAULT_BINARY_WINDOW {
+			// remote ignores acks, stop buffering for it
+			b.lock.Unlock()
+			b.terminate(ErrBinaryWindowExceeded)
+			return
+		}
+		b.chunks = append(b.chunks, data)
+		b.lock.Unlock()
+	case gopcp_stream.STREAM_END:
+		b.fail(io.EOF)
+	case gopcp_stream.STREAM_ERROR:
+		b.fail(errors.New(string(data)))
+	}
+	b.wake()
+}
+
+func (b *BinaryStream) onAck() {
+	select {
+	case <-b.credits:
+	default:
+	}
+}
+
+func (b *BinaryStream) fail(err error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.readErr == nil {
+		b.readErr = err
+	}
+}
+
+func (b *BinaryStream) wake() {
+	select {
+	case b.signal <- struct{}{}:
+	default:
+	}
+}
+
+// nothing will be received or sent any more, chunks received before are still readable
+func (b *BinaryStream) terminate(err error) {
+	b.once.Do(func() {
+		b.closeErr = err
+		close(b.done)
+	})
+	b.fail(err)
+	b.wake()
+}
+
+// binary stream of the id, created by the caller or the handler
+func (p *PCPConnectionHandler) getBinaryStream(sid string) *BinaryStream {
+	stream, _ := p.binaryStreams.LoadOrStore(sid, newBinaryStream(sid, p))
+	return stream.(*BinaryStream)
+}
+
+// stream for a chunk, chunks of caller may arrive before the handler started.
+// then stream is created while the request of handler is not finished.
+func (p *PCPConnectionHandler) acceptBinaryStream(sid string) (*BinaryStream, bool) {
+	if stream, ok := p.binaryStreams.Load(sid); ok {
+		return stream.(*BinaryStream), true
+	}
+
+	p.streamLock.Lock()
+	defer p.streamLock.Unlock()
+	if _, ok := p.streamRequests.Load(sid); !ok {
+		return nil, false
+	}
+	return p.getBinaryStream(sid), true
+}
+
+func (p *PCPConnectionHandler) onBinaryPkt(pkt Pkt) {
+	switch pkt.Kind {
+	case PKT_BINARY_CHUNK:
+		if sid, t, data, ok := parseBinaryChunk(pkt.Body); !ok {
+			atomic.AddInt64(&p.droppedPkts, 1)
+		} else if stream, ok := p.acceptBinaryStream(sid); ok {
+			stream.accept(t, data)
+		}
+	case PKT_BINARY_ACK:
+		if stream, ok := p.binaryStreams.Load(string(pkt.Body)); ok {
+			stream.(*BinaryStream).onAck()
+		}
+	default:
+		atomic.AddInt64(&p.droppedPkts, 1)
+	}
+}
+
+// number of packages dropped, because they are malformed or of unknown kind
+func (p *PCPConnectionHandler) DroppedPackages() int64 {
+	return atomic.LoadInt64(&p.droppedPkts)
+}
+
+// call a binary stream function, defined by BinaryStreamApi at remote.
+// stream is terminated when call finished, ctx is done or connection is closed.
+func (p *PCPConnectionHandler) BinaryStream(ctx context.Context, timeout time.Duration, streamFunName string, params ...interface{}) (*BinaryStream, error) {
+	sid := uuid.NewV4().String()
+	cmdText, err := p.PcpClient.ToJSON(p.PcpClient.Call(streamFunName, append(params, sid)...))
+	if err != nil {
+		return nil, err
+	}
+
+	stream := p.getBinaryStream(sid)
+	if p.isClosed() {
+		p.binaryStreams.Delete(sid)
+		return nil, ErrConnectionClosed
+	}
+
+	// request is sent before returning, so it arrives before chunks written to the stream
+	callCtx, cancel := context.WithCancel(ctx)
+	wait, err := p.sendCall(callCtx, cmdText, timeout)
+	if err != nil {
+		cancel()
+		p.binaryStreams.Delete(sid)
+		return nil, err
+	}
+	go func() {
+		defer cancel()
+		defer p.binaryStreams.Delete(sid)
+		if _, err := wait(); err != nil {
+			stream.terminate(err)
+		} else {
+			stream.terminate(io.EOF)
+		}
+	}()
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			stream.terminate(ctx.Err())
+		case <-stream.done:
+		}
+	}()
+
+	return stream, nil
+}
+
+// define binary stream function, handle reads bytes of caller from stream and writes bytes to caller.
+// writing is closed after handle returned, with error message when handle failed.
+func BinaryStreamApi(handle func(*BinaryStream, []interface{}, interface{}, *gopcp.PcpServer) (interface{}, error)) *gopcp.BoxFunc {
+	// (...args, streamId)
+	return gopcp.ToSandboxFun(func(args []interface{}, attachment interface{}, pcpServer *gopcp.PcpServer) (interface{}, error) {
+		if len(args) < 1 {
+			return nil, errors.New("missing stream id at the stream request")
+		}
+		sid, ok := args[len(args)-1].(string)
+		if !ok {
+			return nil, errors.New("missing stream id (string) at the stream request")
+		}
+		if len(sid) > MAX_BINARY_STREAM_ID_LEN {
+			return nil, ErrBinaryStreamIdTooLong
+		}
+		p, ok := getConnectionHandler(attachment)
+		if !ok {
+			return nil, errors.New("binary stream is only supported over pcp connection.")
+		}
+
+		stream := p.getBinaryStream(sid)
+		defer p.finishStreamRequest(sid)
+
+		// stop when request is canceled or connection is closed
+		ctx := GetContext(attachment)
+		go func() {
+			select {
+			case <-ctx.Done():
+				stream.terminate(ctx.Err())
+			case <-stream.done:
+			}
+		}()
+
+		ret, err := handle(stream, args[:len(args)-1], attachment, pcpServer)
+
+		var closeErr error
+		if err != nil {
+			closeErr = stream.CloseWriteWithError(err.Error())
+		} else {
+			closeErr = stream.CloseWrite()
+		}
+		if closeErr != nil && closeErr != ErrStreamSendClosed && err == nil {
+			err = closeErr
+		}
+		stream.terminate(io.EOF)
+
+		return ret, err
+	})
+}
@@ -0,0 +1,153 @@
+package gopcp_rpc
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/lock-free/gopcp"
+	"github.com/lock-free/gopcp_stream"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+// echo writes back bytes of caller, size counts bytes of caller, hold never reads, fail reads then fails
+func binarySandbox(streamServer *gopcp_stream.StreamServer) *gopcp.Sandbox {
+	return gopcp.GetSandbox(map[string]*gopcp.BoxFunc{
+		"echo": BinaryStreamApi(func(stream *BinaryStream, args []interface{}, attachment interface{}, pcpServer *gopcp.PcpServer) (interface{}, error) {
+			_, err := io.Copy(stream, stream)
+			return nil, err
+		}),
+		"size": BinaryStreamApi(func(stream *BinaryStream, args []interface{}, attachment interface{}, pcpServer *gopcp.PcpServer) (interface{}, error) {
+			data, err := ioutil.ReadAll(stream)
+			return len(data), err
+		}),
+		"hold": BinaryStreamApi(func(stream *BinaryStream, args []interface{}, attachment interface{}, pcpServer *gopcp.PcpServer) (interface{}, error) {
+			<-stream.done
+			return nil, stream.closeErr
+		}),
+		"fail": BinaryStreamApi(func(stream *BinaryStream, args []interface{}, attachment interface{}, pcpServer *gopcp.PcpServer) (interface{}, error) {
+			stream.Write([]byte("partial"))
+			return nil, errors.New("broken")
+		}),
+	})
+}
+
+func testBinaryClient(t *testing.T) (*PCPRPCServer, *PCPConnectionHandler) {
+	server, err := GetPCPRPCServer(0, binarySandbox, nil)
+	if err != nil {
+		t.Fatalf("fail to start server, %v", err)
+	}
+	client, err := GetPCPRPCClient("127.0.0.1", server.GetPort(), simpleSandbox, nil)
+	if err != nil {
+		t.Fatalf("fail to connect, %v", err)
+	}
+	return server, client
+}
+
+func TestBinaryStreamEcho(t *testing.T) {
+	server, client := testBinaryClient(t)
+	defer server.Close()
+	defer client.Close()
+
+	// larger than window * chunk size
+	data := make([]byte, 2*DEFAULT_BINARY_WINDOW*DEFAULT_BINARY_CHUNK_SIZE+7)
+	for i := range data {
+		data[i] = byte(i)
+	}
+
+	stream, err := client.BinaryStream(context.Background(), 10*time.Second, "echo")
+	assertEqual(t, err, nil, "")
+	go func() {
+		stream.Write(data)
+		stream.CloseWrite()
+	}()
+
+	echo, err := ioutil.ReadAll(stream)
+	assertEqual(t, err, nil, "")
+	assertEqual(t, bytes.Equal(echo, data), true, "")
+}
+
+func TestBinaryStreamUpload(t *testing.T) {
+	server, client := testBinaryClient(t)
+	defer server.Close()
+	defer client.Close()
+
+	stream, err := client.BinaryStream(context.Background(), 10*time.Second, "size")
+	assertEqual(t, err, nil, "")
+	n, err := stream.Write(make([]byte, 100000))
+	assertEqual(t, err, nil, "")
+	assertEqual(t, n, 100000, "")
+	assertEqual(t, stream.CloseWrite(), nil, "")
+	_, err = stream.Write([]byte{1})
+	assertEqual(t, err, ErrStreamSendClosed, "")
+
+	_, err = ioutil.ReadAll(stream)
+	assertEqual(t, err, nil, "")
+}
+
+func TestBinaryStreamError(t *testing.T) {
+	server, client := testBinaryClient(t)
+	defer server.Close()
+	defer client.Close()
+
+	stream, err := client.BinaryStream(context.Background(), 10*time.Second, "fail")
+	assertEqual(t, err, nil, "")
+
+	data, err := ioutil.ReadAll(stream)
+	assertEqual(t, string(data), "partial", "")
+	assertEqual(t, err.Error(), "broken", "")
+}
+
+func TestBinaryStreamIgnoringWindow(t *testing.T) {
+	server, client := testBinaryClient(t)
+	defer server.Close()
+	defer client.Close()
+
+	// chunks of unknown streams are dropped
+	pkt, _ := BinaryChunkToPkt("unknown", gopcp_stream.STREAM_DATA, []byte{1})
+	client.packageProtocol.SendPkt(client.ConnHandler, pkt)
+
+	stream, err := client.BinaryStream(context.Background(), 10*time.Second, "hold")
+	assertEqual(t, err, nil, "")
+	// more chunks than window, without waiting for acks
+	for i := 0; i <= DEFAULT_BINARY_WINDOW; i++ {
+		pkt, _ := BinaryChunkToPkt(stream.Id(), gopcp_stream.STREAM_DATA, []byte{1})
+		client.packageProtocol.SendPkt(client.ConnHandler, pkt)
+	}
+
+	_, err = ioutil.ReadAll(stream)
+	assertEqual(t, err.Error(), ErrBinaryWindowExceeded.Error(), "")
+
+	pch := server.Connections()[0]
+	_, ok := pch.binaryStreams.Load("unknown")
+	assertEqual(t, ok, false, "")
+	_, ok = pch.binaryStreams.Load(stream.Id())
+	assertEqual(t, ok, false, "")
+}
+
+func TestBinaryStreamBadPackages(t *testing.T) {
+	server, client := testBinaryClient(t)
+	defer server.Close()
+	defer client.Close()
+
+	// sid longer than the chunk body, then a package of unknown kind
+	client.packageProtocol.SendPkt(client.ConnHandler, toPkt(PKT_BINARY_CHUNK, []byte{0, 10}))
+	client.packageProtocol.SendPkt(client.ConnHandler, toPkt(9, []byte{1}))
+
+	// connection is still usable
+	stream, err := client.BinaryStream(context.Background(), 10*time.Second, "size")
+	assertEqual(t, err, nil, "")
+	stream.Write([]byte{1, 2})
+	stream.CloseWrite()
+	_, err = ioutil.ReadAll(stream)
+	assertEqual(t, err, nil, "")
+	assertEqual(t, server.Connections()[0].DroppedPackages(), int64(2), "")
+
+	// stream id can not be carried by binary chunks
+	cmdText, _ := client.PcpClient.ToJSON(client.PcpClient.Call("size", strings.Repeat("s", MAX_BINARY_STREAM_ID_LEN+1)))
+	_, err = client.CallRemote(cmdText, 10*time.Second)
+	assertEqual(t, err.(*CallError).ErrMsg, ErrBinaryStreamIdTooLong.Error(), "")
+}
@@ -0,0 +1,44 @@
+package gopcp_rpc
+
+import (
+	"context"
+	"fmt"
+	"github.com/lock-free/gopcp"
+	"time"
+)
+
+// request cancellation
+// caller giving up a request sends a cancel package of the same id,
+// remote cancels the context of its execution and drops the response.
+// sandbox functions get the context by GetContext(attachment).
+
+func GetContext(attachment interface{}) context.Context {
+	if m, ok := attachment.(map[string]interface{}); ok {
+		if ctx, ok := m["ctx"].(context.Context); ok {
+			return ctx
+		}
+	}
+	return context.Background()
+}
+
+func (p *PCPConnectionHandler) CallContext(ctx context.Context, list gopcp.CallResult, timeout time.Duration) (interface{}, error) {
+	cmdText, err := p.PcpClient.ToJSON(list)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return p.CallRemoteContext(ctx, cmdText, timeout)
+}
+
+func (p *PCPConnectionHandler) cancelRemote(id string) {
+	if err := p.sendControlPackage(id, CANCEL_C_TYPE); err != nil {
+		fmt.Printf("fail to sent cancel: %v\n", err)
+	}
+}
+
+func (p *PCPConnectionHandler) onCancel(id string) {
+	if cancel, ok := p.requestCancels.Load(id); ok {
+		cancel.(context.CancelFunc)()
+	}
+}
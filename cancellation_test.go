@@ -0,0 +1,57 @@
+package gopcp_rpc
+
+import (
+	"context"
+	"github.com/lock-free/gopcp"
+	"github.com/lock-free/gopcp_stream"
+	"testing"
+	"time"
+)
+
+// lookup waits for delay, canceled receives name when the execution is canceled
+func lookupSandbox(name string, delay time.Duration, canceled chan string) GenerateSandbox {
+	return func(streamServer *gopcp_stream.StreamServer) *gopcp.Sandbox {
+		return gopcp.GetSandbox(map[string]*gopcp.BoxFunc{
+			"lookup": gopcp.ToSandboxFun(func(args []interface{}, attachment interface{}, pcpServer *gopcp.PcpServer) (interface{}, error) {
+				ctx := GetContext(attachment)
+				select {
+				case <-time.After(delay):
+					return name, nil
+				case <-ctx.Done():
+					canceled <- name
+					return nil, ctx.Err()
+				}
+			}),
+		})
+	}
+}
+
+func TestCallCancel(t *testing.T) {
+	canceled := make(chan string, 1)
+	server, err := GetPCPRPCServer(0, lookupSandbox("a", time.Minute, canceled), nil)
+	if err != nil {
+		t.Fatalf("fail to start server, %v", err)
+	}
+	defer server.Close()
+
+	client, err := GetPCPRPCClient("127.0.0.1", server.GetPort(), simpleSandbox, nil)
+	assertEqual(t, err, nil, "")
+	defer client.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		cancel()
+	}()
+
+	p := gopcp.PcpClient{}
+	_, err = client.CallContext(ctx, p.Call("lookup"), time.Minute)
+	assertEqual(t, err, context.Canceled, "")
+
+	select {
+	case name := <-canceled:
+		assertEqual(t, name, "a", "")
+	case <-time.After(time.Second):
+		t.Fatalf("expect remote execution to be canceled")
+	}
+}
@@ -0,0 +1,232 @@
+package gopcp_rpc
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// circuit breaker per backend
+// closed: calls pass, failures are counted in a fixed window which starts over every Window, trip to open when failure rate reaches threshold.
+// open: calls fail fast with ErrCircuitOpen, turn to half-open after open duration.
+// half-open: limited probing calls pass, close when all probes succeed, open again when any probe fails.
+
+type BreakerState int
+
+const (
+	BREAKER_CLOSED BreakerState = iota
+	BREAKER_OPEN
+	BREAKER_HALF_OPEN
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BREAKER_CLOSED:
+		return "closed"
+	case BREAKER_OPEN:
+		return "open"
+	case BREAKER_HALF_OPEN:
+		return "half-open"
+	default:
+		return "unknown(" + strconv.Itoa(int(s)) + ")"
+	}
+}
+
+const DEFAULT_BREAKER_WINDOW = 10 * time.Second
+const DEFAULT_BREAKER_MIN_REQUESTS = 20
+const DEFAULT_BREAKER_ERROR_RATE = 0.5
+const DEFAULT_BREAKER_OPEN_DURATION = 5 * time.Second
+const DEFAULT_BREAKER_HALF_OPEN_MAX_CALLS = 1
+
+var ErrCircuitOpen = errors.New("circuit breaker is open, call is rejected.")
+
+type BreakerOptions struct {
+	// failures are counted in this window
+	Window time.Duration
+	// do not trip before calls in window reach it
+	MinRequests int
+	// trip when rate of failures (transport errors and timeouts) reaches it
+	ErrorRate float64
+	// errors returned by sandbox functions of remote are also failures.
+	// by default they are not, since remote is healthy enough to answer.
+	CountCallErrors bool
+	// trip when rate of timeouts reaches it, not checked when it is 0
+	TimeoutRate float64
+	// stay open for this duration, then half-open
+	OpenDuration time.Duration
+	// number of probing calls in half-open state
+	HalfOpenMaxCalls int
+}
+
+type CircuitBreaker struct {
+	options BreakerOptions
+
+	lock        sync.Mutex
+	state       BreakerState
+	openedAt    time.Time
+	windowStart time.Time
+	requests    int
+	failures    int
+	timeouts    int
+	probing     int // probing calls in flight
+	probed      int // succeeded probing calls
+}
+
+func GetCircuitBreaker(options BreakerOptions) *CircuitBreaker {
+	if options.Window <= 0 {
+		options.Window = DEFAULT_BREAKER_WINDOW
+	}
+	if options.MinRequests <= 0 {
+		options.MinRequests = DEFAULT_BREAKER_MIN_REQUESTS
+	}
+	if options.ErrorRate <= 0 {
+		options.ErrorRate = DEFAULT_BREAKER_ERROR_RATE
+	}
+	if options.OpenDuration <= 0 {
+		options.OpenDuration = DEFAULT_BREAKER_OPEN_DURATION
+	}
+	if options.HalfOpenMaxCalls <= 0 {
+		options.HalfOpenMaxCalls = DEFAULT_BREAKER_HALF_OPEN_MAX_CALLS
+	}
+	return &CircuitBreaker{options: options, windowStart: time.Now()}
+}
+
+func (cb *CircuitBreaker) State() BreakerState {
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+	cb.refresh(time.Now())
+	return cb.state
+}
+
+// turn open to half-open after open duration, start a new window when it expired
+func (cb *CircuitBreaker) refresh(now time.Time) {
+	if cb.state == BREAKER_OPEN && now.Sub(cb.openedAt) >= cb.options.OpenDuration {
+		cb.state = BREAKER_HALF_OPEN
+		cb.probing = 0
+		cb.probed = 0
+	}
+	if now.Sub(cb.windowStart) >= cb.options.Window {
+		cb.resetWindow(now)
+	}
+}
+
+func (cb *CircuitBreaker) resetWindow(now time.Time) {
+	cb.windowStart = now
+	cb.requests = 0
+	cb.failures = 0
+	cb.timeouts = 0
+}
+
+func (cb *CircuitBreaker) trip(now time.Time) {
+	cb.state = BREAKER_OPEN
+	cb.openedAt = now
+	cb.resetWindow(now)
+}
+
+// whether a call could pass now, without taking a probing slot
+func (cb *CircuitBreaker) Ready() bool {
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+	cb.refresh(time.Now())
+	return cb.state == BREAKER_CLOSED || (cb.state == BREAKER_HALF_OPEN && cb.probing < cb.options.HalfOpenMaxCalls)
+}
+
+// ask for passing a call, done should be called with the result of call
+func (cb *CircuitBreaker) Allow() (func(error), error) {
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+
+	cb.refresh(time.Now())
+
+	switch cb.state {
+	case BREAKER_OPEN:
+		return nil, ErrCircuitOpen
+	case BREAKER_HALF_OPEN:
+		if cb.probing >= cb.options.HalfOpenMaxCalls {
+			return nil, ErrCircuitOpen
+		}
+		cb.probing++
+		return cb.doneProbe, nil
+	default:
+		return cb.done, nil
+	}
+}
+
+func (cb *CircuitBreaker) done(err error) {
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+
+	now := time.Now()
+	cb.refresh(now)
+	if cb.state != BREAKER_CLOSED || isNeutralError(err) {
+		return
+	}
+
+	cb.requests++
+	if cb.isFailure(err) {
+		cb.failures++
+		if isTimeoutError(err) {
+			cb.timeouts++
+		}
+	}
+
+	if cb.requests >= cb.options.MinRequests {
+		errorRate := float64(cb.failures) / float64(cb.requests)
+		timeoutRate := float64(cb.timeouts) / float64(cb.requests)
+		if errorRate >= cb.options.ErrorRate || (cb.options.TimeoutRate > 0 && timeoutRate >= cb.options.TimeoutRate) {
+			cb.trip(now)
+		}
+	}
+}
+
+func (cb *CircuitBreaker) doneProbe(err error) {
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+
+	now := time.Now()
+	if cb.state != BREAKER_HALF_OPEN {
+		return
+	}
+
+	cb.probing--
+	if isNeutralError(err) {
+		return
+	} else if cb.isFailure(err) {
+		cb.trip(now)
+	} else {
+		cb.probed++
+		if cb.probed >= cb.options.HalfOpenMaxCalls {
+			cb.state = BREAKER_CLOSED
+			cb.resetWindow(now)
+		}
+	}
+}
+
+// canceled call, and request never written because connection is going away or closed,
+// tell nothing about health of the endpoint. Eg: endpoint is restarted gracefully.
+func isNeutralError(err error) bool {
+	return err == context.Canceled || err == ErrGoingAway || isSendError(err)
+}
+
+func (cb *CircuitBreaker) isFailure(err error) bool {
+	if err == nil {
+		return false
+	}
+	if _, ok := err.(*CallError); ok {
+		return cb.options.CountCallErrors
+	}
+	return true
+}
+
+// call fn through the breaker
+func (cb *CircuitBreaker) Execute(fn func() (interface{}, error)) (interface{}, error) {
+	done, err := cb.Allow()
+	if err != nil {
+		return nil, err
+	}
+	ret, err := fn()
+	done(err)
+	return ret, err
+}
@@ -0,0 +1,159 @@
+package gopcp_rpc
+
+import (
+	"errors"
+	"github.com/lock-free/gopcp"
+	"github.com/lock-free/gopcp_stream"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreakerStates(t *testing.T) {
+	breaker := GetCircuitBreaker(BreakerOptions{MinRequests: 4, ErrorRate: 0.5, OpenDuration: 50 * time.Millisecond})
+	fail := func() (interface{}, error) { return nil, errors.New("fail") }
+	succeed := func() (interface{}, error) { return 1, nil }
+
+	breaker.Execute(succeed)
+	breaker.Execute(succeed)
+	breaker.Execute(fail)
+	assertEqual(t, breaker.State(), BREAKER_CLOSED, "")
+	breaker.Execute(fail)
+	assertEqual(t, breaker.State(), BREAKER_OPEN, "")
+
+	_, err := breaker.Execute(succeed)
+	assertEqual(t, err, ErrCircuitOpen, "")
+
+	// one probe in half-open, failed probe opens it again
+	time.Sleep(60 * time.Millisecond)
+	assertEqual(t, breaker.State(), BREAKER_HALF_OPEN, "")
+	done, err := breaker.Allow()
+	assertEqual(t, err, nil, "")
+	_, err = breaker.Allow()
+	assertEqual(t, err, ErrCircuitOpen, "")
+	done(errors.New("fail"))
+	assertEqual(t, breaker.State(), BREAKER_OPEN, "")
+
+	time.Sleep(60 * time.Millisecond)
+	ret, err := breaker.Execute(succeed)
+	assertEqual(t, ret, 1, "")
+	assertEqual(t, breaker.State(), BREAKER_CLOSED, "")
+}
+
+func TestCircuitBreakerTimeoutRate(t *testing.T) {
+	breaker := GetCircuitBreaker(BreakerOptions{MinRequests: 4, ErrorRate: 0.9, TimeoutRate: 0.25})
+	for i := 0; i < 3; i++ {
+		breaker.Execute(func() (interface{}, error) { return nil, nil })
+	}
+	breaker.Execute(func() (interface{}, error) { return nil, &TimeoutError{"[]", time.Second} })
+	assertEqual(t, breaker.State(), BREAKER_OPEN, "")
+}
+
+func TestCircuitBreakerIgnoresGoingAway(t *testing.T) {
+	breaker := GetCircuitBreaker(BreakerOptions{MinRequests: 2, ErrorRate: 0.5, OpenDuration: 50 * time.Millisecond})
+	for i := 0; i < 4; i++ {
+		breaker.Execute(func() (interface{}, error) { return nil, ErrGoingAway })
+		breaker.Execute(func() (interface{}, error) { return nil, &SendError{ErrConnectionClosed} })
+	}
+	assertEqual(t, breaker.State(), BREAKER_CLOSED, "")
+
+	breaker.Execute(func() (interface{}, error) { return nil, errors.New("fail") })
+	breaker.Execute(func() (interface{}, error) { return nil, errors.New("fail") })
+	assertEqual(t, breaker.State(), BREAKER_OPEN, "")
+
+	// probe which was never sent neither closes nor opens it
+	time.Sleep(60 * time.Millisecond)
+	breaker.Execute(func() (interface{}, error) { return nil, ErrGoingAway })
+	assertEqual(t, breaker.State(), BREAKER_HALF_OPEN, "")
+	assertEqual(t, breaker.Ready(), true, "")
+}
+
+// sandbox of which every call fails
+func failingSandbox(streamServer *gopcp_stream.StreamServer) *gopcp.Sandbox {
+	return gopcp.GetSandbox(map[string]*gopcp.BoxFunc{
+		"name": gopcp.ToSandboxFun(func(args []interface{}, attachment interface{}, pcpServer *gopcp.PcpServer) (interface{}, error) {
+			return nil, errors.New("broken backend")
+		}),
+	})
+}
+
+func TestBalancedClientBreaker(t *testing.T) {
+	servers, endpoints := testBalancedServers(t, "a")
+	defer servers[0].Close()
+	failing, err := GetPCPRPCServer(0, failingSandbox, nil)
+	if err != nil {
+		t.Fatalf("fail to start server, %v", err)
+	}
+	defer failing.Close()
+	endpoints = append(endpoints, Endpoint{"127.0.0.1", failing.GetPort()})
+
+	client := GetBalancedClient(endpoints, simpleSandbox, BalancedClientOptions{
+		Breaker: &BreakerOptions{MinRequests: 2, OpenDuration: time.Minute, CountCallErrors: true},
+	})
+	defer client.Close()
+	waitHealthy(t, client, 2)
+
+	for i := 0; i < 4; i++ {
+		client.CallRemote(`["name"]`, time.Second)
+	}
+
+	for _, state := range client.Backends() {
+		if state.Endpoint == endpoints[1] {
+			assertEqual(t, state.Breaker, BREAKER_OPEN, "")
+		} else {
+			assertEqual(t, state.Breaker, BREAKER_CLOSED, "")
+		}
+	}
+	for i := 0; i < 4; i++ {
+		ret, err := client.CallRemote(`["name"]`, time.Second)
+		assertEqual(t, err, nil, "")
+		assertEqual(t, ret, "a", "")
+	}
+}
+
+func TestPoolBreaker(t *testing.T) {
+	failing, err := GetPCPRPCServer(0, failingSandbox, nil)
+	if err != nil {
+		t.Fatalf("fail to start server, %v", err)
+	}
+	defer failing.Close()
+
+	pool := GetPCPRPCPoolWithOptions(func() (string, int, error) {
+		return "127.0.0.1", failing.GetPort(), nil
+	}, simpleSandbox, 2, 10*time.Millisecond, 10*time.Millisecond, PoolOptions{
+		Breaker: &BreakerOptions{MinRequests: 2, OpenDuration: time.Minute, CountCallErrors: true},
+	})
+	defer pool.Shutdown()
+	time.Sleep(50 * time.Millisecond)
+
+	clients := map[*PCPConnectionHandler]bool{}
+	for i := 0; i < 2; i++ {
+		client, err := pool.Get()
+		assertEqual(t, err, nil, "")
+		clients[client] = true
+		_, err = client.CallRemote(`["name"]`, time.Second)
+		assertEqual(t, err == nil, false, "")
+	}
+
+	// breaker is shared by connections to the same endpoint, connections of open breaker are not picked
+	for client := range clients {
+		_, err := client.CallRemote(`["name"]`, time.Second)
+		assertEqual(t, err, ErrCircuitOpen, "")
+	}
+	_, err = pool.Get()
+	assertEqual(t, err, ErrCircuitOpen, "")
+	_, err = pool.CallRemote(`["name"]`, time.Second)
+	assertEqual(t, err, ErrCircuitOpen, "")
+	assertEqual(t, pool.BreakerStates()[Endpoint{"127.0.0.1", failing.GetPort()}], BREAKER_OPEN, "")
+}
+
+func TestBreakerIgnoresCallErrors(t *testing.T) {
+	breaker := GetCircuitBreaker(BreakerOptions{MinRequests: 2, ErrorRate: 0.3})
+	for i := 0; i < 4; i++ {
+		breaker.Execute(func() (interface{}, error) { return nil, &CallError{ERRNO_EXECUTE_ERROR, "fail"} })
+	}
+	assertEqual(t, breaker.State(), BREAKER_CLOSED, "")
+
+	breaker.Execute(func() (interface{}, error) { return nil, ErrConnectionClosed })
+	breaker.Execute(func() (interface{}, error) { return nil, &TimeoutError{"[]", time.Second} })
+	assertEqual(t, breaker.State(), BREAKER_OPEN, "")
+}
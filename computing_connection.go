@@ -2,6 +2,7 @@ package gopcp_rpc
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -11,6 +12,7 @@ import (
 	"github.com/satori/go.uuid"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -54,18 +56,73 @@ func commandToText(cmd CommandPkt) (string, error) {
 var REQUEST_C_TYPE = "purecall-request"
 var RESPONSE_C_TYPE = "purecall-response"
 
+// control packages
+// goaway: sender is draining, receiver should stop sending new requests and ack it
+var GOAWAY_C_TYPE = "purecall-goaway"
+var GOAWAY_ACK_C_TYPE = "purecall-goaway-ack"
+
+// heartbeat: receiver should answer ping with pong of the same id
+var PING_C_TYPE = "purecall-ping"
+var PONG_C_TYPE = "purecall-pong"
+
+// cancel: caller gave up the request of the same id, receiver cancels the context of its execution
+var CANCEL_C_TYPE = "purecall-cancel"
+
+var ErrGoingAway = errors.New("remote is going away, can not send new requests.")
+var ErrConnectionClosed = errors.New("connection closed.")
+
+// no response in time
+type TimeoutError struct {
+	Command string
+	Timeout time.Duration
+}
+
+func (e *TimeoutError) Error() string {
+	return "timeout for call. Command is " + e.Command + " timeout=" + e.Timeout.String()
+}
+
+// remote answered with an error
+type CallError struct {
+	Errno  int
+	ErrMsg string
+}
+
+func (e *CallError) Error() string {
+	return e.ErrMsg + "(" + strconv.Itoa(e.Errno) + ")"
+}
+
+// request was not sent, since connection is closed or broken
+type SendError struct {
+	Err error
+}
+
+func (e *SendError) Error() string {
+	return e.Err.Error()
+}
+
+func isSendError(err error) bool {
+	_, ok := err.(*SendError)
+	return ok
+}
+
+func isTimeoutError(err error) bool {
+	_, ok := err.(*TimeoutError)
+	return ok
+}
+
 func getErrorMessage(err error) string {
 	return err.Error()
 }
 
-func executeRequestCommand(requestCommand *CommandPkt, pcpServer *gopcp.PcpServer, pch *PCPConnectionHandler) (interface{}, error) {
+func executeRequestCommand(ctx context.Context, requestCommand *CommandPkt, pcpServer *gopcp.PcpServer, pch *PCPConnectionHandler) (interface{}, error) {
 	// request command
 	if text, ok := requestCommand.Data.Text.(string); !ok {
 		return nil, errors.New("Expect string for request command.")
 	} else {
-		// add pch as default attribute to attachment of pcp execution
+		// add pch and ctx as default attributes to attachment of pcp execution
 		return pcpServer.Execute(text, map[string]interface{}{
 			"pch": pch,
+			"ctx": ctx,
 		})
 	}
 }
@@ -73,9 +130,9 @@ func executeRequestCommand(requestCommand *CommandPkt, pcpServer *gopcp.PcpServe
 func packResponse(id string, text interface{}, err error) CommandPkt {
 	var commandData *CommandData = nil
 	if err != nil {
-		commandData = &CommandData{text, 530, getErrorMessage(err)}
+		commandData = &CommandData{text, ERRNO_EXECUTE_ERROR, getErrorMessage(err)}
 	} else {
-		commandData = &CommandData{text, 0, ""}
+		commandData = &CommandData{text, ERRNO_OK, ""}
 	}
 	return CommandPkt{id, RESPONSE_C_TYPE, *commandData}
 }
@@ -83,68 +140,257 @@ func packResponse(id string, text interface{}, err error) CommandPkt {
 type CallChannel struct {
 	data interface{}
 	err  error
+	text string // response package text, for decoding result into typed value
 }
 
 type PCPConnectionHandler struct {
-	packageProtocol *PackageProtocol
-	PcpClient       gopcp.PcpClient
-	pcpServer       *gopcp.PcpServer
-	ConnHandler     *goaio.ConnectionHandler
-	remoteCallMap   sync.Map
-	StreamClient    *gopcp_stream.StreamClient
+	id               string
+	principal        string // guarded by stateLock
+	packageProtocol  *PackageProtocol
+	PcpClient        gopcp.PcpClient
+	pcpServer        *gopcp.PcpServer
+	sandbox          *gopcp.Sandbox
+	ConnHandler      *goaio.ConnectionHandler
+	remoteCallMap    sync.Map
+	StreamClient     *gopcp_stream.StreamClient
+	streamClientLock sync.RWMutex // guards accepting chunks by StreamClient against cleaning it
+	options          ConnectionOptions
+	topics           *TopicBroker    // topics of server, nil at client side
+	breaker          *CircuitBreaker // shared by connections to the same endpoint
+
+	stateLock       *sync.RWMutex
+	goingAway       int32 // remote announced going away
+	goAwaySent      int32
+	goAwaySentAt    int64         // unix nano of sending goaway
+	draining        chan struct{} // closed when goaway is sent, long-lived requests end then
+	goAwayAckOnce   sync.Once
+	goAwayAcked     chan struct{} // remote acked our going away announcement
+	spokeControl    int32         // remote sent a control package, so it could ack goaway
+	spokeJSONRPC    int32         // remote sent a json-rpc request
+	goAwayHandlers  []func()
+	inFlight        int64      // calls sent to remote and waiting for response
+	remoteInFlight  int64      // requests from remote which are being executed
+	requestCancels  sync.Map   // request id -> context.CancelFunc, for requests from remote
+	streamCredits   sync.Map   // stream id -> *streamCredits, for streams produced at this side
+	producedStreams sync.Map   // stream id -> struct{}, streams produced at this side and not ended
+	streamQueues    sync.Map   // stream id -> *streamQueue, for streams consumed at this side
+	bidiInboxes     sync.Map   // stream id -> *Stream, items sent by callers of bidirectional streams
+	streamRequests  sync.Map   // stream id of requests not finished, inboxes are only created for them
+	streamLock      sync.Mutex // guards creating streams of caller against finishing request
+	canceledStreams sync.Map   // stream id -> struct{}, streams produced at this side and canceled by consumer
+	consumedStreams sync.Map   // stream id -> *consumedStream, streams consumed at this side
+	binaryStreams   sync.Map   // stream id -> *BinaryStream
+	droppedPkts     int64      // malformed packages or packages of unknown kind
+
+	pings        sync.Map // ping id -> sent time
+	pendingPings int32    // pings sent without pong
+	latency      int64    // round trip of last heartbeat, in nanoseconds
+	lastActive   int64    // unix nano of last request or response
+
+	errLock   sync.Mutex
+	lastError error // last failure of call or connection
+
+	cleanOnce     sync.Once
+	closed        chan struct{}
+	closeHandlers []func()
 }
 
 func (p *PCPConnectionHandler) OnData(chunk []byte) {
-	texts := p.packageProtocol.GetPktText(chunk)
-	go p.onDataHelp(texts) // execute may be slow, need to run at a seperated goroutine
-}
+	pkts := p.packageProtocol.GetPkts(chunk)
+
+	// responses and control packages are handled in order of arriving,
+	// requests are executed at a seperated goroutine, since execute may be slow.
+	// stream requests may live as long as their streams, every one of them has its own goroutine.
+	var requests []func()
+	var streamRequests []func()
 
-func (p *PCPConnectionHandler) onDataHelp(texts []string) {
-	for _, text := range texts {
-		if cmd, err := stringToCommand(text); err != nil {
+	for _, pkt := range pkts {
+		if pkt.Kind != PKT_TEXT {
+			// binary chunks are only buffered, never block
+			p.touch()
+			p.onBinaryPkt(pkt)
+			continue
+		}
+
+		text := string(pkt.Body)
+		if p.options.JSONRPC && isJSONRPCText(text) {
+			p.touch()
+			atomic.StoreInt32(&p.spokeJSONRPC, 1)
+			jsonRPCText := text
+			// counted before any later package of this read is handled, so draining can not miss it
+			atomic.AddInt64(&p.remoteInFlight, 1)
+			requests = append(requests, func() {
+				p.handleJSONRPC(jsonRPCText)
+			})
+		} else if cmd, err := stringToCommand(text); err != nil {
 			// reset protocol
 			// can not trust rest data either
 			p.packageProtocol.Reset()
 			break
 		} else {
+			if cmd.Ctype != REQUEST_C_TYPE && cmd.Ctype != RESPONSE_C_TYPE {
+				atomic.StoreInt32(&p.spokeControl, 1)
+			}
+
 			switch ctype := cmd.Ctype; ctype {
 			case REQUEST_C_TYPE:
-				// handle request from client
-				result, err := executeRequestCommand(cmd, p.pcpServer, p)
-
-				if cmdText, err := commandToText(packResponse(cmd.Id, result, err)); err != nil {
-					// TODO do more than just log
-					fmt.Printf("fail to convert command to string: %v\n", err)
-				} else if err = p.packageProtocol.SendPackage(p.ConnHandler, cmdText); err != nil {
-					fmt.Printf("fail to sent package: %v\n", err)
+				p.touch()
+				// registered before execution, so cancel arriving later always finds it
+				ctx, cancel := context.WithCancel(context.Background())
+				p.requestCancels.Store(cmd.Id, cancel)
+				request := func() {
+					defer p.requestCancels.Delete(cmd.Id)
+					defer cancel()
+					p.handleRequest(ctx, cmd)
 				}
-
-			case RESPONSE_C_TYPE:
-				// handle response from server
-				if ch_raw, ok := p.remoteCallMap.Load(cmd.Id); !ok {
-					fmt.Printf("missing-pkt-id: can not find id %v in remote call map. Cmd content is %v. Normally, when timeout, the id also will be removed from remote call map.\n", cmd.Id, text)
-				} else {
-					// delete key
-					p.remoteCallMap.Delete(cmd.Id)
-					// pass to channel
-					ch, _ := ch_raw.(chan CallChannel)
-					if cmd.Data.Errno == 0 {
-						ch <- CallChannel{cmd.Data.Text, nil}
+				// stream chunks are delivered in order per stream
+				if !p.dispatchStreamChunk(cmd, request) {
+					// chunks of bidirectional stream may be handled before its handler started
+					atomic.AddInt64(&p.remoteInFlight, 1)
+					if sid, ok := getRequestStreamId(cmd); ok {
+						p.streamRequests.Store(sid, struct{}{})
+						handle := request
+						streamRequests = append(streamRequests, func() {
+							defer p.finishStreamRequest(sid)
+							handle()
+						})
 					} else {
-						errText := cmd.Data.ErrMsg + "(" + strconv.Itoa(cmd.Data.Errno) + ")"
-						ch <- CallChannel{nil, errors.New(errText)}
+						requests = append(requests, request)
 					}
 				}
 
+			case RESPONSE_C_TYPE:
+				p.touch()
+				p.handleResponse(cmd, text)
+
+			case GOAWAY_C_TYPE:
+				// ack waits for requests being sent, reader never blocks on writing
+				go p.onGoAway()
+
+			case GOAWAY_ACK_C_TYPE:
+				p.goAwayAckOnce.Do(func() {
+					close(p.goAwayAcked)
+				})
+
+			case PING_C_TYPE:
+				p.replyControlPackage(cmd.Id, PONG_C_TYPE)
+
+			case PONG_C_TYPE:
+				p.onPong(cmd.Id)
+
+			case CANCEL_C_TYPE:
+				p.onCancel(cmd.Id)
+
 			default:
 				// impossible
 				fmt.Printf("unknown type of package. Type is %v\n", ctype)
 			}
 		}
 	}
+
+	if len(requests) > 0 {
+		go p.onDataHelp(requests)
+	}
+	for _, request := range streamRequests {
+		go p.onDataHelp([]func(){request})
+	}
+}
+
+func (p *PCPConnectionHandler) onDataHelp(requests []func()) {
+	for _, request := range requests {
+		request()
+		atomic.AddInt64(&p.remoteInFlight, -1)
+	}
+}
+
+// handle request from remote
+func (p *PCPConnectionHandler) handleRequest(ctx context.Context, cmd *CommandPkt) {
+	result, err := executeRequestCommand(ctx, cmd, p.pcpServer, p)
+
+	// caller does not wait for it any more
+	if ctx.Err() != nil {
+		return
+	}
+
+	if cmdText, err := commandToText(packResponse(cmd.Id, result, err)); err != nil {
+		// TODO do more than just log
+		fmt.Printf("fail to convert command to string: %v\n", err)
+	} else if err = p.packageProtocol.SendPackage(p.ConnHandler, cmdText); err != nil {
+		fmt.Printf("fail to sent package: %v\n", err)
+	}
 }
 
+// handle response from remote
+func (p *PCPConnectionHandler) handleResponse(cmd *CommandPkt, text string) {
+	if ch_raw, ok := p.remoteCallMap.Load(cmd.Id); !ok {
+		fmt.Printf("missing-pkt-id: can not find id %v in remote call map. Cmd content is %v. Normally, when timeout, the id also will be removed from remote call map.\n", cmd.Id, text)
+	} else {
+		// delete key
+		p.remoteCallMap.Delete(cmd.Id)
+		// pass to channel
+		ch, _ := ch_raw.(chan CallChannel)
+		if cmd.Data.Errno == ERRNO_OK {
+			deliverCallChannel(ch, CallChannel{cmd.Data.Text, nil, text})
+		} else {
+			deliverCallChannel(ch, CallChannel{nil, &CallError{cmd.Data.Errno, cmd.Data.ErrMsg}, text})
+		}
+	}
+}
+
+// calls fail fast when circuit breaker of the endpoint is open
 func (p *PCPConnectionHandler) CallRemote(command string, timeout time.Duration) (interface{}, error) {
+	return p.CallRemoteContext(context.Background(), command, timeout)
+}
+
+// when ctx is done before response, remote is asked to cancel the request
+func (p *PCPConnectionHandler) CallRemoteContext(ctx context.Context, command string, timeout time.Duration) (interface{}, error) {
+	wait, err := p.sendCall(ctx, command, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return wait()
+}
+
+// request is sent when it returns, wait gets the response
+func (p *PCPConnectionHandler) sendCall(ctx context.Context, command string, timeout time.Duration) (func() (interface{}, error), error) {
+	done := func(error) {}
+	if p.breaker != nil {
+		if breakerDone, err := p.breaker.Allow(); err != nil {
+			return nil, err
+		} else {
+			done = breakerDone
+		}
+	}
+	finish := func(ret interface{}, err error) (interface{}, error) {
+		done(err)
+		if err != nil && err != context.Canceled {
+			p.setLastError(err)
+		}
+		return ret, err
+	}
+
+	id, ch, err := p.sendRequest(command)
+	if err != nil {
+		_, err = finish(nil, err)
+		return nil, err
+	}
+	return func() (interface{}, error) {
+		defer atomic.AddInt64(&p.inFlight, -1)
+		return finish(p.waitResponse(ctx, id, ch, command, timeout))
+	}, nil
+}
+
+func (p *PCPConnectionHandler) callRemote(ctx context.Context, command string, timeout time.Duration) (interface{}, error) {
+	id, ch, err := p.sendRequest(command)
+	if err != nil {
+		return nil, err
+	}
+	defer atomic.AddInt64(&p.inFlight, -1)
+	return p.waitResponse(ctx, id, ch, command, timeout)
+}
+
+// send request package, counted in flight until its response is waited
+func (p *PCPConnectionHandler) sendRequest(command string) (string, chan CallChannel, error) {
 	// generate package with unique id
 	uid := uuid.NewV4()
 
@@ -152,36 +398,69 @@ func (p *PCPConnectionHandler) CallRemote(command string, timeout time.Duration)
 	data := CommandPkt{id, REQUEST_C_TYPE, CommandData{command, 0, ""}}
 
 	if cmdText, err := commandToText(data); err != nil {
-		return nil, err
+		return "", nil, err
 	} else {
-		// register channel
-		ch := make(chan CallChannel)
+		// no new requests after remote announced going away
+		p.stateLock.RLock()
+		defer p.stateLock.RUnlock()
+		if p.IsGoingAway() {
+			return "", nil, ErrGoingAway
+		}
+		if p.isClosed() {
+			return "", nil, &SendError{ErrConnectionClosed}
+		}
+
+		atomic.AddInt64(&p.inFlight, 1)
+		p.touch()
+
+		// register channel, buffered so that response, timeout and close never block each other
+		ch := make(chan CallChannel, 1)
 		p.remoteCallMap.Store(id, ch)
 
 		// send package through connection
 		if err := p.packageProtocol.SendPackage(p.ConnHandler, cmdText); err != nil {
 			p.remoteCallMap.Delete(id)
-			return nil, err
-		} else {
-			// timeout action
-			go p.timeoutChannel(id, ch, command, timeout)
+			atomic.AddInt64(&p.inFlight, -1)
+			return "", nil, &SendError{err}
+		}
+		return id, ch, nil
+	}
+}
 
-			// wait for channel
-			ret := <-ch
+func (p *PCPConnectionHandler) waitResponse(ctx context.Context, id string, ch chan CallChannel, command string, timeout time.Duration) (interface{}, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
 
-			if ret.err != nil {
-				return nil, ret.err
-			} else {
-				return ret.data, nil
-			}
-		}
+	// wait for channel
+	var ret CallChannel
+	select {
+	case ret = <-ch:
+	case <-p.closed:
+		p.remoteCallMap.Delete(id)
+		ret = CallChannel{nil, ErrConnectionClosed, ""}
+	case <-ctx.Done():
+		p.remoteCallMap.Delete(id)
+		p.cancelRemote(id)
+		ret = CallChannel{nil, ctx.Err(), ""}
+	case <-timer.C:
+		p.remoteCallMap.Delete(id)
+		ret = CallChannel{nil, &TimeoutError{command, timeout}, ""}
+	}
+
+	if ret.err != nil {
+		return nil, ret.err
+	} else {
+		setResultText(ctx, ret.text)
+		return ret.data, nil
 	}
 }
 
-func (p *PCPConnectionHandler) timeoutChannel(id string, ch chan CallChannel, command string, timeout time.Duration) {
-	time.Sleep(timeout)
-	ch <- CallChannel{nil, errors.New("timeout for call. Command is " + command + " timeout=" + timeout.String())}
-	p.remoteCallMap.Delete(id)
+// never block, a call gets only the first result
+func deliverCallChannel(ch chan CallChannel, ret CallChannel) {
+	select {
+	case ch <- ret:
+	default:
+	}
 }
 
 func (p *PCPConnectionHandler) Call(list gopcp.CallResult, timeout time.Duration) (interface{}, error) {
@@ -194,11 +473,203 @@ func (p *PCPConnectionHandler) Call(list gopcp.CallResult, timeout time.Duration
 	return p.CallRemote(cmdText, timeout)
 }
 
+func (p *PCPConnectionHandler) sendControlPackage(id string, ctype string) error {
+	if cmdText, err := commandToText(CommandPkt{id, ctype, CommandData{nil, ERRNO_OK, ""}}); err != nil {
+		return err
+	} else {
+		return p.packageProtocol.SendPackage(p.ConnHandler, cmdText)
+	}
+}
+
+// reply is written aside, reader never blocks on writing.
+// Otherwise both sides could block on full send buffers, while nobody reads.
+func (p *PCPConnectionHandler) replyControlPackage(id string, ctype string) {
+	go func() {
+		if err := p.sendControlPackage(id, ctype); err != nil {
+			fmt.Printf("fail to sent %s: %v\n", ctype, err)
+		}
+	}()
+}
+
+// remote is draining, stop sending new requests, then ack it.
+// Packages are ordered in connection, so remote will receive all our requests before the ack.
+func (p *PCPConnectionHandler) onGoAway() {
+	p.stateLock.Lock()
+	if !atomic.CompareAndSwapInt32(&p.goingAway, 0, 1) {
+		p.stateLock.Unlock()
+		return
+	}
+	for _, handler := range p.goAwayHandlers {
+		go handler()
+	}
+	p.stateLock.Unlock()
+
+	// not under stateLock, failed sending closes connection and Clean takes stateLock
+	if err := p.sendControlPackage(uuid.NewV4().String(), GOAWAY_ACK_C_TYPE); err != nil {
+		fmt.Printf("fail to sent goaway ack: %v\n", err)
+	}
+}
+
+// register handler called when remote announces going away, called immediately if already announced
+func (p *PCPConnectionHandler) OnGoAway(handler func()) {
+	p.stateLock.Lock()
+	defer p.stateLock.Unlock()
+
+	if p.IsGoingAway() {
+		go handler()
+	} else {
+		p.goAwayHandlers = append(p.goAwayHandlers, handler)
+	}
+}
+
+// announce remote that we are draining
+func (p *PCPConnectionHandler) GoAway() error {
+	if atomic.CompareAndSwapInt32(&p.goAwaySent, 0, 1) {
+		atomic.StoreInt64(&p.goAwaySentAt, time.Now().UnixNano())
+		close(p.draining)
+		return p.sendControlPackage(uuid.NewV4().String(), GOAWAY_C_TYPE)
+	}
+	return nil
+}
+
+func (p *PCPConnectionHandler) IsGoingAway() bool {
+	return atomic.LoadInt32(&p.goingAway) == 1
+}
+
+// number of calls waiting for response from remote
+func (p *PCPConnectionHandler) InFlight() int {
+	return int(atomic.LoadInt64(&p.inFlight))
+}
+
+func (p *PCPConnectionHandler) setLastError(err error) {
+	p.errLock.Lock()
+	defer p.errLock.Unlock()
+	p.lastError = err
+}
+
+func (p *PCPConnectionHandler) LastError() error {
+	p.errLock.Lock()
+	defer p.errLock.Unlock()
+	return p.lastError
+}
+
+func (p *PCPConnectionHandler) isClosed() bool {
+	select {
+	case <-p.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// after GoAway, drained when remote acked and no calls in flight at both sides.
+// Json-rpc peers and older peers never ack, they are drained without it. Peers which never sent
+// a control package are given goAwayAckWait to ack, since we can not tell whether they are older.
+func (p *PCPConnectionHandler) isDrained() bool {
+	if atomic.LoadInt64(&p.remoteInFlight) != 0 || atomic.LoadInt64(&p.inFlight) != 0 {
+		return false
+	}
+
+	select {
+	case <-p.goAwayAcked:
+		return true
+	default:
+	}
+
+	if atomic.LoadInt32(&p.spokeControl) == 1 {
+		return false
+	} else if atomic.LoadInt32(&p.spokeJSONRPC) == 1 {
+		return true
+	}
+	sentAt := atomic.LoadInt64(&p.goAwaySentAt)
+	return sentAt > 0 && time.Since(time.Unix(0, sentAt)) >= goAwayAckWait
+}
+
 func (p *PCPConnectionHandler) Close() {
-	p.ConnHandler.Close(nil)
+	p.closeWithError(nil)
+}
+
+// err is passed to the close handler of connection
+func (p *PCPConnectionHandler) closeWithError(err error) {
+	p.ConnHandler.Close(err)
 	p.Clean()
 }
 
+// register handler called when connection closed, called immediately if already closed
+func (p *PCPConnectionHandler) OnClose(handler func()) {
+	p.stateLock.Lock()
+	defer p.stateLock.Unlock()
+
+	select {
+	case <-p.closed:
+		go handler()
+	default:
+		p.closeHandlers = append(p.closeHandlers, handler)
+	}
+}
+
+// close connection after calls waiting for response finished
+func (p *PCPConnectionHandler) closeWhenDrained() {
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+
+	for p.InFlight() > 0 {
+		select {
+		case <-p.closed:
+			return
+		case <-ticker.C:
+		}
+	}
+	p.Close()
+}
+
 func (p *PCPConnectionHandler) Clean() {
-	p.StreamClient.Clean()
+	p.cleanOnce.Do(func() {
+		// everything waiting on the connection is finished before closed is signalled,
+		// so goroutines woken by closed never see the connection half cleaned
+		p.streamClientLock.Lock()
+		p.StreamClient.Clean()
+		p.streamClientLock.Unlock()
+
+		// streams consumed at this side will never end
+		p.terminateStreams(ErrConnectionClosed)
+
+		// fail calls which are waiting for response
+		p.remoteCallMap.Range(func(id, ch_raw interface{}) bool {
+			p.remoteCallMap.Delete(id)
+			ch, _ := ch_raw.(chan CallChannel)
+			deliverCallChannel(ch, CallChannel{nil, ErrConnectionClosed, ""})
+			return true
+		})
+
+		// nobody receives responses of requests from remote any more
+		p.requestCancels.Range(func(id, cancel interface{}) bool {
+			cancel.(context.CancelFunc)()
+			return true
+		})
+
+		p.bidiInboxes.Range(func(id, inbox interface{}) bool {
+			p.bidiInboxes.Delete(id)
+			inbox.(*Stream).finish(ErrConnectionClosed)
+			return true
+		})
+
+		p.binaryStreams.Range(func(id, stream interface{}) bool {
+			p.binaryStreams.Delete(id)
+			stream.(*BinaryStream).terminate(ErrConnectionClosed)
+			return true
+		})
+
+		p.stateLock.Lock()
+		close(p.closed)
+		closeHandlers := p.closeHandlers
+		p.stateLock.Unlock()
+
+		// registered while cleaning, calls and streams of caller wait on closed themselves
+		p.terminateStreams(ErrConnectionClosed)
+
+		for _, handler := range closeHandlers {
+			go handler()
+		}
+	})
 }
@@ -0,0 +1,111 @@
+package gopcp_rpc
+
+import (
+	"context"
+	"errors"
+	"github.com/lock-free/gopcp"
+	"sync"
+	"time"
+)
+
+// connection registry of pcp rpc server
+// every connection has an id, and a principal set by application after authentication, eg: in a login sandbox function.
+// server calls client side sandbox functions on connections by id, by principal or on all of them.
+// eg:
+//   pch.SetPrincipal("user-1")
+//   results := server.SendToPrincipal(ctx, "user-1", p.Call("notify", "hello"), time.Second)
+
+// connections called concurrently by one push
+const DEFAULT_PUSH_CONCURRENCY = 32
+
+var ErrConnectionNotFound = errors.New("connection is not found.")
+
+type PushResult struct {
+	ConnectionId string
+	Principal    string
+	Result       interface{}
+	Err          error
+}
+
+func (p *PCPConnectionHandler) Id() string {
+	return p.id
+}
+
+func (p *PCPConnectionHandler) SetPrincipal(principal string) {
+	p.stateLock.Lock()
+	defer p.stateLock.Unlock()
+	p.principal = principal
+}
+
+func (p *PCPConnectionHandler) Principal() string {
+	p.stateLock.RLock()
+	defer p.stateLock.RUnlock()
+	return p.principal
+}
+
+func (s *PCPRPCServer) Connection(id string) (*PCPConnectionHandler, bool) {
+	if pcpConnectionHandler, ok := s.byId.Load(id); ok {
+		return pcpConnectionHandler.(*PCPConnectionHandler), true
+	}
+	return nil, false
+}
+
+func (s *PCPRPCServer) Connections() []*PCPConnectionHandler {
+	var handlers []*PCPConnectionHandler
+	s.rangeConnections(func(pcpConnectionHandler *PCPConnectionHandler) {
+		handlers = append(handlers, pcpConnectionHandler)
+	})
+	return handlers
+}
+
+// connections authenticated as principal
+func (s *PCPRPCServer) ConnectionsOf(principal string) []*PCPConnectionHandler {
+	var handlers []*PCPConnectionHandler
+	s.rangeConnections(func(pcpConnectionHandler *PCPConnectionHandler) {
+		if pcpConnectionHandler.Principal() == principal {
+			handlers = append(handlers, pcpConnectionHandler)
+		}
+	})
+	return handlers
+}
+
+// call client side sandbox function on the connection of id
+func (s *PCPRPCServer) Send(ctx context.Context, id string, list gopcp.CallResult, timeout time.Duration) (interface{}, error) {
+	if pcpConnectionHandler, ok := s.Connection(id); !ok {
+		return nil, ErrConnectionNotFound
+	} else {
+		return pcpConnectionHandler.CallContext(ctx, list, timeout)
+	}
+}
+
+// call client side sandbox function on all connections of principal
+func (s *PCPRPCServer) SendToPrincipal(ctx context.Context, principal string, list gopcp.CallResult, timeout time.Duration) []PushResult {
+	return push(ctx, s.ConnectionsOf(principal), list, timeout)
+}
+
+// call client side sandbox function on all connections
+func (s *PCPRPCServer) Broadcast(ctx context.Context, list gopcp.CallResult, timeout time.Duration) []PushResult {
+	return push(ctx, s.Connections(), list, timeout)
+}
+
+// results are in the order of handlers
+func push(ctx context.Context, handlers []*PCPConnectionHandler, list gopcp.CallResult, timeout time.Duration) []PushResult {
+	results := make([]PushResult, len(handlers))
+	sem := make(chan struct{}, DEFAULT_PUSH_CONCURRENCY)
+	var wg sync.WaitGroup
+
+	for i, pcpConnectionHandler := range handlers {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, pcpConnectionHandler *PCPConnectionHandler) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			ret, err := pcpConnectionHandler.CallContext(ctx, list, timeout)
+			results[i] = PushResult{pcpConnectionHandler.Id(), pcpConnectionHandler.Principal(), ret, err}
+		}(i, pcpConnectionHandler)
+	}
+
+	wg.Wait()
+	return results
+}
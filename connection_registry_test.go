@@ -0,0 +1,64 @@
+package gopcp_rpc
+
+import (
+	"context"
+	"github.com/lock-free/gopcp"
+	"github.com/lock-free/gopcp_stream"
+	"testing"
+	"time"
+)
+
+// login sets principal of the connection
+func registrySandbox(streamServer *gopcp_stream.StreamServer) *gopcp.Sandbox {
+	return gopcp.GetSandbox(map[string]*gopcp.BoxFunc{
+		"login": gopcp.ToSandboxFun(func(args []interface{}, attachment interface{}, pcpServer *gopcp.PcpServer) (interface{}, error) {
+			pch, _ := getConnectionHandler(attachment)
+			pch.SetPrincipal(args[0].(string))
+			return pch.Id(), nil
+		}),
+	})
+}
+
+func TestConnectionRegistry(t *testing.T) {
+	server, err := GetPCPRPCServer(0, registrySandbox, nil)
+	if err != nil {
+		t.Fatalf("fail to start server, %v", err)
+	}
+	defer server.Close()
+
+	p := gopcp.PcpClient{}
+	ids := map[string]string{}
+	for _, login := range [][]string{{"a1", "alice"}, {"a2", "alice"}, {"b1", "bob"}} {
+		client, err := GetPCPRPCClient("127.0.0.1", server.GetPort(), namedSandbox(login[0]), nil)
+		assertEqual(t, err, nil, "")
+		defer client.Close()
+		id, err := client.Call(p.Call("login", login[1]), time.Second)
+		assertEqual(t, err, nil, "")
+		ids[login[0]] = id.(string)
+	}
+
+	assertEqual(t, len(server.Connections()), 3, "")
+	assertEqual(t, len(server.ConnectionsOf("alice")), 2, "")
+
+	ret, err := server.Send(context.Background(), ids["b1"], p.Call("name"), time.Second)
+	assertEqual(t, err, nil, "")
+	assertEqual(t, ret, "b1", "")
+	_, err = server.Send(context.Background(), "unknown", p.Call("name"), time.Second)
+	assertEqual(t, err, ErrConnectionNotFound, "")
+
+	names := map[string]bool{}
+	for _, result := range server.SendToPrincipal(context.Background(), "alice", p.Call("name"), time.Second) {
+		assertEqual(t, result.Err, nil, "")
+		assertEqual(t, result.Principal, "alice", "")
+		assertEqual(t, ids[result.Result.(string)], result.ConnectionId, "")
+		names[result.Result.(string)] = true
+	}
+	assertEqual(t, len(names), 2, "")
+	assertEqual(t, names["a1"] && names["a2"], true, "")
+
+	results := server.Broadcast(context.Background(), p.Call("name"), time.Second)
+	assertEqual(t, len(results), 3, "")
+	for _, result := range results {
+		assertEqual(t, result.Err, nil, "")
+	}
+}
@@ -1,3 +1,18 @@
 package gopcp_rpc
 
 const STREAM_ACCEPT_NAME = "__stream_accept"
+
+// accepts chunks sent by caller of bidirectional stream
+const BIDI_ACCEPT_NAME = "__bidi_accept"
+
+// consumer tells producer that a stream is canceled
+const STREAM_CANCEL_NAME = "__stream_cancel"
+
+// subscribes a topic of remote, messages are delivered as a stream
+const SUBSCRIBE_NAME = "__subscribe"
+
+// errno of command data
+const ERRNO_OK = 0
+const ERRNO_BAD_REQUEST = 400
+const ERRNO_FUNCTION_NOT_FOUND = 404
+const ERRNO_EXECUTE_ERROR = 530
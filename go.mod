@@ -1,6 +1,6 @@
 module github.com/lock-free/gopcp_rpc
 
-go 1.12
+go 1.18
 
 require (
 	github.com/creack/pty v1.1.9 // indirect
@@ -12,4 +12,5 @@ require (
 	github.com/lock-free/gopool v0.0.0-20190611034900-329206275cf0
 	github.com/satori/go.uuid v1.2.0
 	gopkg.in/check.v1 v1.0.0-20190902080502-41f04d3bba15 // indirect
+	gopkg.in/yaml.v2 v2.4.0
 )
@@ -0,0 +1,68 @@
+package gopcp_rpc
+
+import (
+	"errors"
+	"fmt"
+	"github.com/satori/go.uuid"
+	"sync/atomic"
+	"time"
+)
+
+// application-level heartbeat
+// ping is sent to remote on every interval, connection is closed when missed heartbeats reach max missed.
+// Half-open connections are detected without waiting for calls to time out.
+
+const DEFAULT_HEARTBEAT_MAX_MISSED = 3
+
+var ErrHeartbeatTimeout = errors.New("heartbeat timeout, remote does not answer ping.")
+
+func (p *PCPConnectionHandler) heartbeat(interval time.Duration, maxMissed int) {
+	if maxMissed <= 0 {
+		maxMissed = DEFAULT_HEARTBEAT_MAX_MISSED
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.closed:
+			return
+		case <-ticker.C:
+			if int(atomic.LoadInt32(&p.pendingPings)) >= maxMissed {
+				p.closeWithError(ErrHeartbeatTimeout)
+				return
+			}
+			p.ping()
+		}
+	}
+}
+
+func (p *PCPConnectionHandler) ping() {
+	id := uuid.NewV4().String()
+	p.pings.Store(id, time.Now())
+	atomic.AddInt32(&p.pendingPings, 1)
+
+	if err := p.sendControlPackage(id, PING_C_TYPE); err != nil {
+		fmt.Printf("fail to sent ping: %v\n", err)
+	}
+}
+
+func (p *PCPConnectionHandler) onPong(id string) {
+	if sentAt, ok := p.pings.Load(id); ok {
+		p.pings.Delete(id)
+		atomic.StoreInt64(&p.latency, int64(time.Since(sentAt.(time.Time))))
+	}
+
+	// remote is alive, forget missed pings
+	p.pings.Range(func(id, _ interface{}) bool {
+		p.pings.Delete(id)
+		return true
+	})
+	atomic.StoreInt32(&p.pendingPings, 0)
+}
+
+// round-trip latency of the last heartbeat, 0 if no heartbeat answered yet
+func (p *PCPConnectionHandler) Latency() time.Duration {
+	return time.Duration(atomic.LoadInt64(&p.latency))
+}
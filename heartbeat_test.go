@@ -0,0 +1,71 @@
+package gopcp_rpc
+
+import (
+	"github.com/lock-free/goaio"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestHeartbeatLatency(t *testing.T) {
+	server, err := GetPCPRPCServer(0, simpleSandbox, nil)
+	if err != nil {
+		t.Fatalf("fail to start server, %v", err)
+	}
+	defer server.Close()
+
+	client, err := GetPCPRPCClientWithOptions("127.0.0.1", server.GetPort(), simpleSandbox, nil, ConnectionOptions{
+		HeartbeatInterval: 10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("fail to connect, %v", err)
+	}
+	defer client.Close()
+
+	time.Sleep(100 * time.Millisecond)
+	if client.Latency() <= 0 {
+		t.Errorf("expect heartbeat latency, but got %v", client.Latency())
+	}
+
+	ret, err := client.CallRemote(`["add", 1, 2]`, time.Second)
+	assertEqual(t, err, nil, "")
+	assertEqual(t, ret, 3.0, "")
+}
+
+func TestHeartbeatMissed(t *testing.T) {
+	// server never answers
+	server, err := goaio.GetTcpServer(0, func(conn net.Conn) goaio.ConnectionHandler {
+		return goaio.GetConnectionHandler(conn, func([]byte) {}, func(error) {})
+	})
+	if err != nil {
+		t.Fatalf("fail to start server, %v", err)
+	}
+	go server.Accepts()
+	defer server.Close()
+
+	closeErr := make(chan error, 1)
+	client, err := GetPCPRPCClientWithOptions("127.0.0.1", server.GetPort(), simpleSandbox, func(err error) {
+		closeErr <- err
+	}, ConnectionOptions{
+		HeartbeatInterval:  10 * time.Millisecond,
+		HeartbeatMaxMissed: 2,
+	})
+	if err != nil {
+		t.Fatalf("fail to connect, %v", err)
+	}
+
+	// pending call fails when connection is closed, instead of waiting for timeout
+	start := time.Now()
+	_, err = client.CallRemote(`["add", 1, 2]`, 10*time.Second)
+	assertEqual(t, err, ErrConnectionClosed, "")
+	if time.Since(start) > time.Second {
+		t.Errorf("call should fail once connection is closed")
+	}
+
+	select {
+	case err := <-closeErr:
+		assertEqual(t, err, ErrHeartbeatTimeout, "")
+	case <-time.After(time.Second):
+		t.Fatalf("connection should be closed")
+	}
+}
@@ -0,0 +1,92 @@
+package gopcp_rpc
+
+import (
+	"context"
+	"time"
+)
+
+// hedged requests
+// when no response after delay, the same request is sent again over another connection or backend,
+// the first successful result wins and the other attempts are canceled.
+// only idempotent functions should be hedged, since remote may execute the request more than once.
+
+const DEFAULT_HEDGE_MAX_ATTEMPTS = 2
+
+type HedgePolicy struct {
+	// send another attempt when no response after it
+	Delay time.Duration
+	// attempts including the first one
+	MaxAttempts int
+	// names of idempotent functions which are hedged
+	Functions []string
+}
+
+func (policy *HedgePolicy) hedges(command string) bool {
+	if policy == nil || policy.Delay <= 0 {
+		return false
+	}
+	name := commandFunctionName(command)
+	for _, fun := range policy.Functions {
+		if fun == name {
+			return true
+		}
+	}
+	return false
+}
+
+// attempt(ctx, n) sends the n-th attempt, it should avoid connections or backends used by former attempts
+func hedge(ctx context.Context, policy *HedgePolicy, command string, attempt func(ctx context.Context, n int) (interface{}, error)) (interface{}, error) {
+	if !policy.hedges(command) {
+		return attempt(ctx, 0)
+	}
+
+	maxAttempts := policy.MaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = DEFAULT_HEDGE_MAX_ATTEMPTS
+	}
+
+	// cancels losers when returned
+	attemptCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan CallChannel, maxAttempts)
+	sent := 0
+	send := func() {
+		n := sent
+		sent++
+		go func() {
+			ret, err := attempt(attemptCtx, n)
+			results <- CallChannel{ret, err, ""}
+		}()
+	}
+
+	send()
+	timer := time.NewTimer(policy.Delay)
+	defer timer.Stop()
+
+	var lastErr error
+	received := 0
+	for {
+		select {
+		case ret := <-results:
+			received++
+			if ret.err == nil {
+				return ret.data, nil
+			}
+			lastErr = ret.err
+			// failures are left to retry policy
+			if received == sent {
+				return nil, lastErr
+			}
+
+		case <-timer.C:
+			if sent < maxAttempts {
+				send()
+				timer.Reset(policy.Delay)
+			}
+
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package gopcp_rpc
+
+import (
+	"github.com/lock-free/gopcp"
+	"testing"
+	"time"
+)
+
+func TestBalancedClientHedge(t *testing.T) {
+	canceled := make(chan string, 1)
+	var endpoints []Endpoint
+	for _, server := range []struct {
+		name  string
+		delay time.Duration
+	}{{"slow", time.Minute}, {"fast", 10 * time.Millisecond}} {
+		s, err := GetPCPRPCServer(0, lookupSandbox(server.name, server.delay, canceled), nil)
+		if err != nil {
+			t.Fatalf("fail to start server, %v", err)
+		}
+		defer s.Close()
+		endpoints = append(endpoints, Endpoint{"127.0.0.1", s.GetPort()})
+	}
+
+	client := GetBalancedClient(endpoints, simpleSandbox, BalancedClientOptions{
+		Hedge: &HedgePolicy{Delay: 30 * time.Millisecond, Functions: []string{"lookup"}},
+	})
+	defer client.Close()
+	waitHealthy(t, client, 2)
+
+	p := gopcp.PcpClient{}
+	for i := 0; i < 2; i++ {
+		start := time.Now()
+		ret, err := client.Call(p.Call("lookup"), 5*time.Second)
+		assertEqual(t, err, nil, "")
+		assertEqual(t, ret, "fast", "")
+		if time.Since(start) > time.Second {
+			t.Errorf("hedged call should not wait for the slow backend")
+		}
+	}
+
+	// loser on slow backend is canceled
+	select {
+	case name := <-canceled:
+		assertEqual(t, name, "slow", "")
+	case <-time.After(time.Second):
+		t.Fatalf("expect slow attempt to be canceled")
+	}
+}
+
+func TestHedgePolicy(t *testing.T) {
+	var policy *HedgePolicy
+	assertEqual(t, policy.hedges(`["lookup"]`), false, "")
+	policy = &HedgePolicy{Delay: time.Millisecond, Functions: []string{"lookup"}}
+	assertEqual(t, policy.hedges(`["lookup", 1]`), true, "")
+	assertEqual(t, policy.hedges(`["update", 1]`), false, "")
+}
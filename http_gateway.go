@@ -0,0 +1,257 @@
+package gopcp_rpc
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/lock-free/gopcp"
+	"github.com/lock-free/gopcp_stream"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// http gateway for consumers which can not hold a long-lived tcp connection
+//
+// POST body could be:
+//   (1) pcp expression: ["add", 1, 2]
+//   (2) function call: {"fun": "add", "args": [1, 2]}
+//
+// response body is the json of CommandData, errno is mapped to http status code.
+// For stream calling (set "stream": true, query stream=1, or Accept: text/event-stream),
+// stream chunks are delivered as server-sent events: data, end, error.
+// Stream functions end their stream by themselves, even after returning. For other functions,
+// the result is delivered as data, then the stream ends.
+
+const DEFAULT_HTTP_MAX_BODY_BYTES = 1 << 20
+
+var ErrHTTPBodyTooLarge = errors.New("http request body is too large.")
+
+type HTTPGatewayOptions struct {
+	// requests with larger body are rejected with 413, default is DEFAULT_HTTP_MAX_BODY_BYTES
+	MaxBodyBytes int64
+}
+
+type HTTPCallRequest struct {
+	Fun    string        `json:"fun"`
+	Args   []interface{} `json:"args"`
+	Stream bool          `json:"stream"`
+}
+
+type PCPHTTPHandler struct {
+	sandbox      *gopcp.Sandbox
+	pcpServer    *gopcp.PcpServer
+	pcpClient    gopcp.PcpClient
+	streamClient *gopcp_stream.StreamClient
+	options      HTTPGatewayOptions
+}
+
+// build http handler, sandbox functions are executed against the pcp server generated from generateSandbox
+func GetPCPHTTPHandler(generateSandbox GenerateSandbox) *PCPHTTPHandler {
+	return GetPCPHTTPHandlerWithOptions(generateSandbox, HTTPGatewayOptions{})
+}
+
+func GetPCPHTTPHandlerWithOptions(generateSandbox GenerateSandbox, options HTTPGatewayOptions) *PCPHTTPHandler {
+	if options.MaxBodyBytes <= 0 {
+		options.MaxBodyBytes = DEFAULT_HTTP_MAX_BODY_BYTES
+	}
+
+	var pcpServer *gopcp.PcpServer
+	streamClient := gopcp_stream.GetStreamClient()
+
+	// stream chunks are accepted by the gateway itself, then written to http response
+	sandbox := newSandbox(generateSandbox, streamClient, func(command string, timeout time.Duration) (interface{}, error) {
+		return pcpServer.Execute(command, nil)
+	})
+	pcpServer = gopcp.NewPcpServer(sandbox)
+
+	return &PCPHTTPHandler{sandbox, pcpServer, gopcp.PcpClient{}, streamClient, options}
+}
+
+func ErrnoToHTTPStatus(errno int) int {
+	switch errno {
+	case ERRNO_OK:
+		return http.StatusOK
+	case ERRNO_BAD_REQUEST:
+		return http.StatusBadRequest
+	case ERRNO_FUNCTION_NOT_FOUND:
+		return http.StatusNotFound
+	case ERRNO_EXECUTE_ERROR:
+		return http.StatusInternalServerError
+	default:
+		return http.StatusBadGateway
+	}
+}
+
+func (h *PCPHTTPHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeHTTPCommandData(w, http.StatusMethodNotAllowed, CommandData{nil, ERRNO_BAD_REQUEST, "only POST is supported"})
+		return
+	}
+
+	exp, stream, err := h.parseHTTPRequest(w, r)
+	if err == ErrHTTPBodyTooLarge {
+		writeHTTPCommandData(w, http.StatusRequestEntityTooLarge, CommandData{nil, ERRNO_BAD_REQUEST, getErrorMessage(err)})
+		return
+	} else if err != nil {
+		writeHTTPCommandData(w, ErrnoToHTTPStatus(ERRNO_BAD_REQUEST), CommandData{nil, ERRNO_BAD_REQUEST, getErrorMessage(err)})
+		return
+	}
+
+	// expression always starts with function name after parsing
+	boxFun, err := h.sandbox.Get(exp[0].(string))
+	if err != nil {
+		writeHTTPCommandData(w, ErrnoToHTTPStatus(ERRNO_FUNCTION_NOT_FOUND), CommandData{nil, ERRNO_FUNCTION_NOT_FOUND, getErrorMessage(err)})
+		return
+	}
+
+	attachment := map[string]interface{}{
+		"httpRequest": r,
+	}
+
+	if stream {
+		h.serveStream(w, r, exp, attachment, isStreamBoxFun(boxFun))
+		return
+	}
+
+	result, err := h.pcpServer.ExecuteJsonObj(exp, attachment)
+	data := packResponse("", result, err).Data
+	writeHTTPCommandData(w, ErrnoToHTTPStatus(data.Errno), data)
+}
+
+// parse http body to pcp json object
+func (h *PCPHTTPHandler) parseHTTPRequest(w http.ResponseWriter, r *http.Request) ([]interface{}, bool, error) {
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, h.options.MaxBodyBytes))
+	if err != nil {
+		if int64(len(body)) >= h.options.MaxBodyBytes {
+			return nil, false, ErrHTTPBodyTooLarge
+		}
+		return nil, false, err
+	}
+
+	stream := r.URL.Query().Get("stream") == "1" || strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+	text := strings.TrimSpace(string(body))
+
+	if strings.HasPrefix(text, "[") {
+		var exp []interface{}
+		if err := json.Unmarshal([]byte(text), &exp); err != nil {
+			return nil, false, err
+		}
+		if len(exp) == 0 {
+			return nil, false, errors.New("empty pcp expression.")
+		}
+		if _, ok := exp[0].(string); !ok {
+			return nil, false, errors.New("pcp expression should start with function name.")
+		}
+		return exp, stream, nil
+	} else if strings.HasPrefix(text, "{") {
+		var callRequest HTTPCallRequest
+		if err := json.Unmarshal([]byte(text), &callRequest); err != nil {
+			return nil, false, err
+		}
+		if callRequest.Fun == "" {
+			return nil, false, errors.New("missing function name, eg: {\"fun\": \"add\", \"args\": [1, 2]}")
+		}
+		exp, _ := h.pcpClient.Call(callRequest.Fun, callRequest.Args...).Result.([]interface{})
+		return exp, stream || callRequest.Stream, nil
+	} else {
+		return nil, false, errors.New("request body should be a pcp expression or a function call object.")
+	}
+}
+
+// functions defined by StreamApi of stream server, they may send chunks after returning
+func isStreamBoxFun(boxFun *gopcp.BoxFunc) bool {
+	fun := runtime.FuncForPC(reflect.ValueOf(boxFun.Fun).Pointer())
+	return fun != nil && strings.HasPrefix(fun.Name(), "github.com/lock-free/gopcp_stream.")
+}
+
+func (h *PCPHTTPHandler) serveStream(w http.ResponseWriter, r *http.Request, exp []interface{}, attachment interface{}, streamFun bool) {
+	flusher, _ := w.(http.Flusher)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	if flusher != nil {
+		flusher.Flush()
+	}
+
+	var writeLock sync.Mutex
+	finished := false
+	done := make(chan struct{})
+
+	streamId := h.streamClient.StreamCallback(func(t int, d interface{}) {
+		writeLock.Lock()
+		defer writeLock.Unlock()
+
+		if finished {
+			return
+		}
+
+		switch t {
+		case gopcp_stream.STREAM_DATA:
+			writeSSEEvent(w, "data", d)
+		case gopcp_stream.STREAM_END:
+			writeSSEEvent(w, "end", nil)
+		default:
+			writeSSEEvent(w, "error", CommandData{nil, ERRNO_EXECUTE_ERROR, fmt.Sprintf("%v", d)})
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+
+		if t != gopcp_stream.STREAM_DATA {
+			finished = true
+			close(done)
+		}
+	})
+
+	go func() {
+		// stream id is the last argument of stream api
+		result, err := h.pcpServer.ExecuteJsonObj(append(exp, streamId), attachment)
+		if err != nil {
+			h.streamClient.Accept(streamId, gopcp_stream.STREAM_ERROR, getErrorMessage(err))
+			return
+		}
+
+		// stream function sends end or error by itself, maybe after returning
+		if streamFun {
+			return
+		}
+
+		// not a stream function, result is the only item
+		if result != nil {
+			h.streamClient.Accept(streamId, gopcp_stream.STREAM_DATA, result)
+		}
+		h.streamClient.Accept(streamId, gopcp_stream.STREAM_END, nil)
+	}()
+
+	select {
+	case <-done:
+	case <-r.Context().Done():
+		// consumer is gone, remove stream callback
+		h.streamClient.Accept(streamId, gopcp_stream.STREAM_ERROR, "http request closed")
+	}
+}
+
+func writeHTTPCommandData(w http.ResponseWriter, status int, data CommandData) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if bytes, err := JSONMarshal(data); err != nil {
+		fmt.Printf("fail to convert command data to json: %v\n", err)
+	} else {
+		w.Write(bytes)
+	}
+}
+
+func writeSSEEvent(w http.ResponseWriter, event string, data interface{}) {
+	if bytes, err := JSONMarshal(data); err != nil {
+		fmt.Printf("fail to convert stream chunk to json: %v\n", err)
+	} else {
+		fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, strings.TrimSpace(string(bytes)))
+	}
+}
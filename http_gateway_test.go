@@ -0,0 +1,125 @@
+package gopcp_rpc
+
+import (
+	"encoding/json"
+	"github.com/lock-free/gopcp"
+	"github.com/lock-free/gopcp_stream"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testHTTPPost(t *testing.T, url string, body string, accept string) (int, string) {
+	req, err := http.NewRequest(http.MethodPost, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("fail to build request, %v", err)
+	}
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("fail to post, %v", err)
+	}
+	defer resp.Body.Close()
+	bytes, _ := ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, string(bytes)
+}
+
+func TestHTTPGateway(t *testing.T) {
+	server := httptest.NewServer(GetPCPHTTPHandler(simpleSandbox))
+	defer server.Close()
+
+	status, body := testHTTPPost(t, server.URL, `["add", 1, 2]`, "")
+	assertEqual(t, status, http.StatusOK, "")
+	var data CommandData
+	if err := json.Unmarshal([]byte(body), &data); err != nil {
+		t.Fatalf("fail to parse response, %v", err)
+	}
+	assertEqual(t, data.Text, 3.0, "")
+
+	status, body = testHTTPPost(t, server.URL, `{"fun": "sum", "args": [[1, 2, 3]]}`, "")
+	assertEqual(t, status, http.StatusOK, "")
+	json.Unmarshal([]byte(body), &data)
+	assertEqual(t, data.Text, 6.0, "")
+
+	status, body = testHTTPPost(t, server.URL, `["testError"]`, "")
+	assertEqual(t, status, http.StatusInternalServerError, "")
+	json.Unmarshal([]byte(body), &data)
+	assertEqual(t, data.Errno, ERRNO_EXECUTE_ERROR, "")
+	assertEqual(t, data.ErrMsg, "errrrorrr", "")
+
+	status, _ = testHTTPPost(t, server.URL, `add(1, 2)`, "")
+	assertEqual(t, status, http.StatusBadRequest, "")
+
+	status, body = testHTTPPost(t, server.URL, `["missing", 1]`, "")
+	assertEqual(t, status, http.StatusNotFound, "")
+	json.Unmarshal([]byte(body), &data)
+	assertEqual(t, data.Errno, ERRNO_FUNCTION_NOT_FOUND, "")
+}
+
+func TestHTTPGatewayStream(t *testing.T) {
+	server := httptest.NewServer(GetPCPHTTPHandler(func(streamServer *gopcp_stream.StreamServer) *gopcp.Sandbox {
+		return gopcp.GetSandbox(map[string]*gopcp.BoxFunc{
+			"identity": gopcp.ToSandboxFun(func(args []interface{}, attachment interface{}, pcpServer *gopcp.PcpServer) (interface{}, error) {
+				return args[0], nil
+			}),
+			"streamApi": streamServer.StreamApi(func(
+				streamProducer gopcp_stream.StreamProducer,
+				args []interface{},
+				attachment interface{},
+				pcpServer *gopcp.PcpServer,
+			) (interface{}, error) {
+				seed := args[0].(string)
+				streamProducer.SendData(seed+"1", 10*time.Second)
+				streamProducer.SendData(seed+"2", 10*time.Second)
+				streamProducer.SendEnd(10 * time.Second)
+				return nil, nil
+			}),
+			// returns at once, chunks are sent later
+			"asyncStreamApi": streamServer.StreamApi(func(
+				streamProducer gopcp_stream.StreamProducer,
+				args []interface{},
+				attachment interface{},
+				pcpServer *gopcp.PcpServer,
+			) (interface{}, error) {
+				go func() {
+					time.Sleep(50 * time.Millisecond)
+					streamProducer.SendData("late", 10*time.Second)
+					streamProducer.SendEnd(10 * time.Second)
+				}()
+				return nil, nil
+			}),
+		})
+	}))
+	defer server.Close()
+
+	status, body := testHTTPPost(t, server.URL, `{"fun": "streamApi", "args": ["_"], "stream": true}`, "")
+	assertEqual(t, status, http.StatusOK, "")
+	assertEqual(t, body, "event: data\ndata: \"_1\"\n\nevent: data\ndata: \"_2\"\n\nevent: end\ndata: null\n\n", "")
+
+	_, body = testHTTPPost(t, server.URL, `["streamApi", "a"]`, "text/event-stream")
+	assertEqual(t, body, "event: data\ndata: \"a1\"\n\nevent: data\ndata: \"a2\"\n\nevent: end\ndata: null\n\n", "")
+
+	// not a stream function, result is the only item
+	_, body = testHTTPPost(t, server.URL+"?stream=1", `["identity", 1]`, "")
+	assertEqual(t, body, "event: data\ndata: 1\n\nevent: end\ndata: null\n\n", "")
+
+	// stream is not ended when stream function returned
+	_, body = testHTTPPost(t, server.URL+"?stream=1", `["asyncStreamApi"]`, "")
+	assertEqual(t, body, "event: data\ndata: \"late\"\n\nevent: end\ndata: null\n\n", "")
+}
+
+func TestHTTPGatewayMaxBody(t *testing.T) {
+	server := httptest.NewServer(GetPCPHTTPHandlerWithOptions(simpleSandbox, HTTPGatewayOptions{MaxBodyBytes: 16}))
+	defer server.Close()
+
+	status, _ := testHTTPPost(t, server.URL, `["add", 1, 2]`, "")
+	assertEqual(t, status, http.StatusOK, "")
+
+	status, _ = testHTTPPost(t, server.URL, `["add", 1, 2, 3, 4, 5, 6, 7, 8]`, "")
+	assertEqual(t, status, http.StatusRequestEntityTooLarge, "")
+}
@@ -0,0 +1,65 @@
+package gopcp_rpc
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// idle timeout of server connections
+// connection is idle when there is no request or response (heartbeats are not counted) in the timeout,
+// and no calls or streams in flight.
+
+var ErrIdleTimeout = errors.New("connection idle timeout.")
+
+// mark activity of connection
+func (p *PCPConnectionHandler) touch() {
+	atomic.StoreInt64(&p.lastActive, time.Now().UnixNano())
+}
+
+func (p *PCPConnectionHandler) idleFor() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&p.lastActive)))
+}
+
+func (p *PCPConnectionHandler) isIdle(timeout time.Duration) bool {
+	return p.idleFor() >= timeout && atomic.LoadInt64(&p.inFlight) == 0 && atomic.LoadInt64(&p.remoteInFlight) == 0 && !p.hasOpenStreams()
+}
+
+// streams are open between chunks, also after the stream function returned.
+// stream of producer is open from its first chunk.
+func (p *PCPConnectionHandler) hasOpenStreams() bool {
+	for _, streams := range []*sync.Map{&p.consumedStreams, &p.producedStreams, &p.streamCredits, &p.bidiInboxes, &p.binaryStreams} {
+		open := false
+		streams.Range(func(_, _ interface{}) bool {
+			open = true
+			return false
+		})
+		if open {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *PCPConnectionHandler) closeWhenIdle(timeout time.Duration) {
+	interval := timeout / 2
+	if interval < time.Millisecond {
+		interval = time.Millisecond
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.closed:
+			return
+		case <-ticker.C:
+			if p.isIdle(timeout) {
+				p.closeWithError(ErrIdleTimeout)
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,209 @@
+package gopcp_rpc
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// json-rpc 2.0 compatibility mode
+// envelopes are detected on the same package framing, method and params are translated into pcp calls:
+//   {"jsonrpc": "2.0", "method": "add", "params": [1, 2], "id": 1} => ["add", 1, 2]
+// object params are passed as a single map argument.
+
+const JSONRPC_VERSION = "2.0"
+
+// json-rpc error codes
+const JSONRPC_PARSE_ERROR = -32700
+const JSONRPC_INVALID_REQUEST = -32600
+const JSONRPC_METHOD_NOT_FOUND = -32601
+const JSONRPC_INVALID_PARAMS = -32602
+const JSONRPC_SERVER_ERROR = -32000
+
+type JSONRPCRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+	Id      json.RawMessage `json:"id,omitempty"`
+}
+
+type JSONRPCError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type JSONRPCResponse struct {
+	JSONRPC string
+	Result  interface{}
+	Error   *JSONRPCError
+	Id      json.RawMessage
+}
+
+// result and error are exclusive, result should exist (even null) when succeed
+func (r JSONRPCResponse) MarshalJSON() ([]byte, error) {
+	id := r.Id
+	if len(id) == 0 {
+		id = json.RawMessage("null")
+	}
+	if r.Error != nil {
+		return json.Marshal(struct {
+			JSONRPC string          `json:"jsonrpc"`
+			Error   *JSONRPCError   `json:"error"`
+			Id      json.RawMessage `json:"id"`
+		}{r.JSONRPC, r.Error, id})
+	}
+	return json.Marshal(struct {
+		JSONRPC string          `json:"jsonrpc"`
+		Result  interface{}     `json:"result"`
+		Id      json.RawMessage `json:"id"`
+	}{r.JSONRPC, r.Result, id})
+}
+
+// batch request is a json array, pcp command package is always a json object
+func isJSONRPCText(text string) bool {
+	trimmed := strings.TrimSpace(text)
+	if strings.HasPrefix(trimmed, "[") {
+		return true
+	}
+	var envelope struct {
+		JSONRPC string `json:"jsonrpc"`
+	}
+	return json.Unmarshal([]byte(trimmed), &envelope) == nil && envelope.JSONRPC != ""
+}
+
+func (p *PCPConnectionHandler) handleJSONRPC(text string) {
+	if resText, ok := p.executeJSONRPC(text); ok {
+		if err := p.packageProtocol.SendPackage(p.ConnHandler, resText); err != nil {
+			fmt.Printf("fail to sent package: %v\n", err)
+		}
+	}
+}
+
+// returns response text, false when there is nothing to respond (notifications)
+func (p *PCPConnectionHandler) executeJSONRPC(text string) (string, bool) {
+	trimmed := strings.TrimSpace(text)
+
+	var res interface{}
+	if strings.HasPrefix(trimmed, "[") {
+		var batch []json.RawMessage
+		if err := json.Unmarshal([]byte(trimmed), &batch); err != nil {
+			res = jsonRPCErrorResponse(nil, JSONRPC_PARSE_ERROR, err.Error())
+		} else if len(batch) == 0 {
+			res = jsonRPCErrorResponse(nil, JSONRPC_INVALID_REQUEST, "empty batch")
+		} else {
+			responses := p.executeJSONRPCBatch(batch)
+			if len(responses) == 0 {
+				return "", false
+			}
+			res = responses
+		}
+	} else if response := p.executeJSONRPCRequest([]byte(trimmed)); response != nil {
+		res = response
+	} else {
+		return "", false
+	}
+
+	if bytes, err := JSONMarshal(res); err != nil {
+		fmt.Printf("fail to convert json-rpc response to string: %v\n", err)
+		return "", false
+	} else {
+		return strings.TrimSpace(string(bytes)), true
+	}
+}
+
+// requests in batch are executed concurrently, responses keep the order of requests
+func (p *PCPConnectionHandler) executeJSONRPCBatch(batch []json.RawMessage) []*JSONRPCResponse {
+	results := make([]*JSONRPCResponse, len(batch))
+	var wg sync.WaitGroup
+	for i, raw := range batch {
+		wg.Add(1)
+		go func(i int, raw json.RawMessage) {
+			defer wg.Done()
+			results[i] = p.executeJSONRPCRequest(raw)
+		}(i, raw)
+	}
+	wg.Wait()
+
+	var responses []*JSONRPCResponse
+	for _, response := range results {
+		if response != nil {
+			responses = append(responses, response)
+		}
+	}
+	return responses
+}
+
+// returns nil for notification
+func (p *PCPConnectionHandler) executeJSONRPCRequest(raw []byte) *JSONRPCResponse {
+	var req JSONRPCRequest
+	if err := json.Unmarshal(raw, &req); err != nil {
+		if _, ok := err.(*json.SyntaxError); ok {
+			return jsonRPCErrorResponse(nil, JSONRPC_PARSE_ERROR, err.Error())
+		}
+		return jsonRPCErrorResponse(nil, JSONRPC_INVALID_REQUEST, err.Error())
+	}
+
+	isNotification := len(req.Id) == 0
+
+	if req.JSONRPC != JSONRPC_VERSION || req.Method == "" {
+		return jsonRPCErrorResponse(req.Id, JSONRPC_INVALID_REQUEST, "invalid json-rpc 2.0 request")
+	}
+
+	if _, err := p.sandbox.Get(req.Method); err != nil {
+		if isNotification {
+			return nil
+		}
+		return jsonRPCErrorResponse(req.Id, JSONRPC_METHOD_NOT_FOUND, err.Error())
+	}
+
+	args, err := jsonRPCParamsToArgs(req.Params)
+	if err != nil {
+		if isNotification {
+			return nil
+		}
+		return jsonRPCErrorResponse(req.Id, JSONRPC_INVALID_PARAMS, err.Error())
+	}
+
+	result, err := p.pcpServer.ExecuteJsonObj(p.PcpClient.Call(req.Method, args...).Result, map[string]interface{}{
+		"pch": p,
+	})
+
+	if isNotification {
+		return nil
+	}
+	if err != nil {
+		return jsonRPCErrorResponse(req.Id, JSONRPC_SERVER_ERROR, getErrorMessage(err))
+	}
+	return &JSONRPCResponse{JSONRPC_VERSION, result, nil, req.Id}
+}
+
+// by-position params are passed as arguments, by-name params are passed as a single map argument
+func jsonRPCParamsToArgs(params json.RawMessage) ([]interface{}, error) {
+	trimmed := bytes.TrimSpace(params)
+	if len(trimmed) == 0 || string(trimmed) == "null" {
+		return nil, nil
+	}
+
+	switch trimmed[0] {
+	case '[':
+		var args []interface{}
+		if err := json.Unmarshal(trimmed, &args); err != nil {
+			return nil, err
+		}
+		return args, nil
+	case '{':
+		var arg map[string]interface{}
+		if err := json.Unmarshal(trimmed, &arg); err != nil {
+			return nil, err
+		}
+		return []interface{}{arg}, nil
+	default:
+		return nil, fmt.Errorf("params should be array or object, but got %s", string(trimmed))
+	}
+}
+
+func jsonRPCErrorResponse(id json.RawMessage, code int, message string) *JSONRPCResponse {
+	return &JSONRPCResponse{JSONRPC_VERSION, nil, &JSONRPCError{code, message}, id}
+}
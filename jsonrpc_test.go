@@ -0,0 +1,105 @@
+package gopcp_rpc
+
+import (
+	"encoding/json"
+	"github.com/lock-free/goaio"
+	"testing"
+	"time"
+)
+
+// send raw text packages to server, collect response texts
+func testRawPackages(t *testing.T, port int, texts []string, expectCount int) []string {
+	p := GetPackageProtocol()
+	ch := make(chan string, 10)
+	connHandler, err := goaio.GetTcpClient("127.0.0.1", port, func(data []byte) {
+		for _, text := range p.GetPktText(data) {
+			ch <- text
+		}
+	}, func(error) {})
+	if err != nil {
+		t.Fatalf("fail to connect, %v", err)
+	}
+	go connHandler.ReadFromConn()
+	defer connHandler.Close(nil)
+
+	for _, text := range texts {
+		if err := p.SendPackage(&connHandler, text); err != nil {
+			t.Fatalf("fail to send package, %v", err)
+		}
+	}
+
+	var result []string
+	for i := 0; i < expectCount; i++ {
+		select {
+		case text := <-ch:
+			result = append(result, text)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timeout for json-rpc response")
+		}
+	}
+	return result
+}
+
+func TestJSONRPC(t *testing.T) {
+	server, err := GetPCPRPCServerWithOptions(0, simpleSandbox, nil, ServerOptions{ConnectionOptions: ConnectionOptions{JSONRPC: true}})
+	if err != nil {
+		t.Fatalf("fail to start server, %v", err)
+	}
+	defer server.Close()
+
+	texts := testRawPackages(t, server.GetPort(), []string{
+		`{"jsonrpc": "2.0", "method": "add", "params": [1, 2], "id": 1}`,
+		`{"jsonrpc": "2.0", "method": "testError", "id": "a"}`,
+		`{"jsonrpc": "2.0", "method": "fakkkkkkkkkk", "id": 2}`,
+		`{"jsonrpc": "2.0", "method": "add", "params": [1, 2]}`,
+		`{"jsonrpc": "2.0", "method": "sum", "params": [[1, 2, 3]], "id": 3}`,
+	}, 4)
+
+	// responses may be out of order, index them by id
+	responses := map[string]string{}
+	for _, text := range texts {
+		var res struct {
+			Id json.RawMessage `json:"id"`
+		}
+		json.Unmarshal([]byte(text), &res)
+		responses[string(res.Id)] = text
+	}
+
+	assertEqual(t, responses["1"], `{"jsonrpc":"2.0","result":3,"id":1}`, "")
+	assertEqual(t, responses[`"a"`], `{"jsonrpc":"2.0","error":{"code":-32000,"message":"errrrorrr"},"id":"a"}`, "")
+	assertEqual(t, responses["3"], `{"jsonrpc":"2.0","result":6,"id":3}`, "")
+
+	var res map[string]interface{}
+	json.Unmarshal([]byte(responses["2"]), &res)
+	assertEqual(t, res["error"].(map[string]interface{})["code"], float64(JSONRPC_METHOD_NOT_FOUND), "")
+}
+
+func TestJSONRPCBatch(t *testing.T) {
+	server, err := GetPCPRPCServerWithOptions(0, simpleSandbox, nil, ServerOptions{ConnectionOptions: ConnectionOptions{JSONRPC: true}})
+	if err != nil {
+		t.Fatalf("fail to start server, %v", err)
+	}
+	defer server.Close()
+
+	texts := testRawPackages(t, server.GetPort(), []string{
+		`[{"jsonrpc": "2.0", "method": "add", "params": [1, 2], "id": 1}, {"jsonrpc": "2.0", "method": "add", "params": [3]}, {"jsonrpc": "2.0", "method": "identity", "params": {"a": 1}, "id": 2}]`,
+		`[]`,
+	}, 2)
+
+	// responses may be out of order
+	if texts[0][0] != '[' {
+		texts[0], texts[1] = texts[1], texts[0]
+	}
+	assertEqual(t, texts[0], `[{"jsonrpc":"2.0","result":3,"id":1},{"jsonrpc":"2.0","result":{"a":1},"id":2}]`, "")
+	assertEqual(t, texts[1], `{"jsonrpc":"2.0","error":{"code":-32600,"message":"empty batch"},"id":null}`, "")
+
+	// pcp clients still work on the same server
+	client, err := GetPCPRPCClient("127.0.0.1", server.GetPort(), simpleSandbox, nil)
+	if err != nil {
+		t.Fatalf("fail to connect, %v", err)
+	}
+	defer client.Close()
+	ret, err := client.CallRemote(`["add", 1, 2]`, time.Second)
+	assertEqual(t, err, nil, "")
+	assertEqual(t, ret, 3.0, "")
+}
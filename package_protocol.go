@@ -2,25 +2,66 @@ package gopcp_rpc
 
 import (
 	"encoding/binary"
+	"errors"
 	"github.com/lock-free/goaio"
 	"sync"
 )
 
 // package header
 // Bytes:  0      1     2    3    4
-//      version [    body size      ]
+//       kind  [    body size      ]
 // TODO checksum for safety
 
 var headerLen = 5
 
-func TextToPkt(text string) []byte {
-	bytes := []byte(text)
-	lenOfTextBytes := len(bytes)
+// kind of package, text packages carry pcp commands,
+// binary packages carry raw bytes of binary streams, bypassing json encoding.
+const PKT_TEXT byte = 0
+const PKT_BINARY_CHUNK byte = 1
+const PKT_BINARY_ACK byte = 2
+
+// sid length of binary chunk is 1 byte
+const MAX_BINARY_STREAM_ID_LEN = 255
 
+var ErrBinaryStreamIdTooLong = errors.New("stream id of binary chunk is longer than 255 bytes.")
+
+type Pkt struct {
+	Kind byte
+	Body []byte
+}
+
+func toPkt(kind byte, body []byte) []byte {
 	// body size bytes
 	lenBytes := make([]byte, 4)
-	binary.BigEndian.PutUint32(lenBytes, uint32(lenOfTextBytes))
-	return append(append([]byte{0}, lenBytes...), bytes...)
+	binary.BigEndian.PutUint32(lenBytes, uint32(len(body)))
+	return append(append([]byte{kind}, lenBytes...), body...)
+}
+
+func TextToPkt(text string) []byte {
+	return toPkt(PKT_TEXT, []byte(text))
+}
+
+// body of binary chunk is [chunk type: 1 byte][sid length: 1 byte][sid][data]
+func BinaryChunkToPkt(sid string, t int, data []byte) ([]byte, error) {
+	if len(sid) > MAX_BINARY_STREAM_ID_LEN {
+		return nil, ErrBinaryStreamIdTooLong
+	}
+	body := make([]byte, 0, 2+len(sid)+len(data))
+	body = append(append(append(body, byte(t), byte(len(sid))), sid...), data...)
+	return toPkt(PKT_BINARY_CHUNK, body), nil
+}
+
+func BinaryAckToPkt(sid string) []byte {
+	return toPkt(PKT_BINARY_ACK, []byte(sid))
+}
+
+// sid, chunk type and data of binary chunk body
+func parseBinaryChunk(body []byte) (string, int, []byte, bool) {
+	if len(body) < 2 || len(body) < 2+int(body[1]) {
+		return "", 0, nil, false
+	}
+	sidLen := int(body[1])
+	return string(body[2 : 2+sidLen]), int(body[0]), body[2+sidLen:], true
 }
 
 type PackageProtocol struct {
@@ -36,15 +77,33 @@ func (p *PackageProtocol) SendPackage(connHandler *goaio.ConnectionHandler, text
 	return connHandler.SendBytes(TextToPkt(text))
 }
 
+// send a package built by BinaryChunkToPkt or BinaryAckToPkt
+func (p *PackageProtocol) SendPkt(connHandler *goaio.ConnectionHandler, pkt []byte) error {
+	p.sentLock.Lock()
+	defer p.sentLock.Unlock()
+	return connHandler.SendBytes(pkt)
+}
+
+// text packages only, packages of other kinds are dropped
 func (p *PackageProtocol) GetPktText(data []byte) []string {
+	var result []string
+	for _, pkt := range p.GetPkts(data) {
+		if pkt.Kind == PKT_TEXT {
+			result = append(result, string(pkt.Body))
+		}
+	}
+	return result
+}
+
+func (p *PackageProtocol) GetPkts(data []byte) []Pkt {
 	p.bufferLocker.Lock()
 	defer p.bufferLocker.Unlock()
 
 	p.buffer = append(p.buffer, data...)
 
-	var result []string
-	for pktText := p.getSinglePkt(); pktText != ""; pktText = p.getSinglePkt() {
-		result = append(result, pktText)
+	var result []Pkt
+	for pkt, ok := p.getSinglePkt(); ok; pkt, ok = p.getSinglePkt() {
+		result = append(result, pkt)
 	}
 	return result
 }
@@ -57,21 +116,24 @@ func (p *PackageProtocol) Reset() {
 	p.buffer = empty
 }
 
-func (p *PackageProtocol) getSinglePkt() string {
-	if len(p.buffer) <= headerLen {
-		return ""
+func (p *PackageProtocol) getSinglePkt() (Pkt, bool) {
+	if len(p.buffer) < headerLen {
+		return Pkt{}, false
 	}
 
 	bodyLen := binary.BigEndian.Uint32(p.buffer[1:5])
 	pktLen := headerLen + int(bodyLen)
 
 	if len(p.buffer) >= pktLen {
-		pkt := p.buffer[headerLen:pktLen]
+		// copy body, buffer is reused by following data
+		body := make([]byte, int(bodyLen))
+		copy(body, p.buffer[headerLen:pktLen])
+		pkt := Pkt{p.buffer[0], body}
 		// update buffer
 		p.buffer = p.buffer[pktLen:]
-		return string(pkt)
+		return pkt, true
 	} else {
-		return ""
+		return Pkt{}, false
 	}
 }
 
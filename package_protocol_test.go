@@ -2,6 +2,7 @@ package gopcp_rpc
 
 import (
 	"fmt"
+	"strings"
 	"testing"
 )
 
@@ -48,3 +49,27 @@ func TestGetPktText(t *testing.T) {
 		assertEqual(t, r2[0], text, "")
 	}
 }
+
+func TestBinaryPkt(t *testing.T) {
+	p := GetPackageProtocol()
+	chunk, err := BinaryChunkToPkt("sid", 0, []byte{1, 2, 3})
+	assertEqual(t, err, nil, "")
+	pkts := p.GetPkts(append(append(chunk, BinaryAckToPkt("sid")...), TextToPkt("hello")...))
+	assertEqual(t, len(pkts), 3, "")
+
+	assertEqual(t, pkts[0].Kind, PKT_BINARY_CHUNK, "")
+	sid, ct, data, ok := parseBinaryChunk(pkts[0].Body)
+	assertEqual(t, ok, true, "")
+	assertEqual(t, sid, "sid", "")
+	assertEqual(t, ct, 0, "")
+	assertEqualBytes(t, data, []byte{1, 2, 3})
+
+	assertEqual(t, pkts[1].Kind, PKT_BINARY_ACK, "")
+	assertEqual(t, string(pkts[1].Body), "sid", "")
+	assertEqual(t, pkts[2].Kind, PKT_TEXT, "")
+	assertEqual(t, string(pkts[2].Body), "hello", "")
+
+	// sid length is 1 byte
+	_, err = BinaryChunkToPkt(strings.Repeat("s", MAX_BINARY_STREAM_ID_LEN+1), 0, []byte{1})
+	assertEqual(t, err, ErrBinaryStreamIdTooLong, "")
+}
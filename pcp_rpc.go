@@ -5,10 +5,12 @@ import (
 	"github.com/lock-free/gopcp"
 	"github.com/lock-free/gopcp_stream"
 	"github.com/lock-free/gopool"
+	"github.com/satori/go.uuid"
 	"log"
 	"net"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -17,33 +19,69 @@ type GetTcpConn = func(goaio.BytesReadHandler, goaio.OnCloseHandler) (goaio.Conn
 
 type GenerateSandbox = func(*gopcp_stream.StreamServer) *gopcp.Sandbox
 
+// build sandbox from the sandbox generator, stream chunks produced by the sandbox are sent by callFun
+func newSandbox(generateSandbox GenerateSandbox, streamClient *gopcp_stream.StreamClient, callFun gopcp_stream.CallFunc) *gopcp.Sandbox {
+	streamServer := gopcp_stream.GetStreamServer(STREAM_ACCEPT_NAME, callFun)
+	// default stream accept api
+	boxMap := map[string]*gopcp.BoxFunc{}
+	boxMap[STREAM_ACCEPT_NAME] = getStreamAcceptBoxFun(streamClient)
+	boxMap[BIDI_ACCEPT_NAME] = getBidiAcceptBoxFun()
+	boxMap[STREAM_CANCEL_NAME] = getStreamCancelBoxFun()
+	boxMap[SUBSCRIBE_NAME] = getSubscribeBoxFun(streamServer)
+
+	return gopcp.GetSandbox(boxMap).Extend(generateSandbox(streamServer))
+}
+
+// options of pcp connection handler
+type ConnectionOptions struct {
+	// accept json-rpc 2.0 envelopes on the same framing
+	JSONRPC bool
+	// interval to ping remote, no heartbeat when it is 0
+	HeartbeatInterval time.Duration
+	// close connection after missing this number of heartbeats, default is DEFAULT_HEARTBEAT_MAX_MISSED
+	HeartbeatMaxMissed int
+	// stream chunks sent without ack per stream, producer blocks when it is reached.
+	// 0 means every chunk waits for its ack.
+	StreamWindow int
+}
+
 func GetPcpConnectionHandlerFromTcpConn(t int, generateSandbox GenerateSandbox, getTcpConn GetTcpConn) (*PCPConnectionHandler, error) {
+	return getPcpConnectionHandler(t, generateSandbox, getTcpConn, ConnectionOptions{})
+}
+
+func getPcpConnectionHandler(t int, generateSandbox GenerateSandbox, getTcpConn GetTcpConn, options ConnectionOptions) (*PCPConnectionHandler, error) {
 	var pcpConnectionHandler *PCPConnectionHandler
-	var remoteCallMap sync.Map
 
 	pcpClient := gopcp.PcpClient{}
 
 	// create stream object
 	streamClient := gopcp_stream.GetStreamClient()
-	streamServer := gopcp_stream.GetStreamServer(STREAM_ACCEPT_NAME, func(command string, timeout time.Duration) (interface{}, error) {
-		return pcpConnectionHandler.CallRemote(command, timeout)
-	})
-	// default stream accept api
-	boxMap := map[string]*gopcp.BoxFunc{}
-	boxMap[STREAM_ACCEPT_NAME] = gopcp_stream.GetPcpStreamAcceptBoxFun(streamClient)
 
 	// create pcp server
-	pcpServer := gopcp.NewPcpServer(gopcp.GetSandbox(boxMap).Extend(generateSandbox(streamServer)))
+	sandbox := newSandbox(generateSandbox, streamClient, func(command string, timeout time.Duration) (interface{}, error) {
+		return pcpConnectionHandler.sendStreamChunk(command, timeout)
+	})
+	pcpServer := gopcp.NewPcpServer(sandbox)
 
 	pcpConnectionHandler = &PCPConnectionHandler{packageProtocol: GetPackageProtocol(),
-		PcpClient:     pcpClient,
-		pcpServer:     pcpServer,
-		ConnHandler:   nil,
-		remoteCallMap: remoteCallMap,
-		StreamClient:  streamClient,
+		id:           uuid.NewV4().String(),
+		PcpClient:    pcpClient,
+		pcpServer:    pcpServer,
+		sandbox:      sandbox,
+		ConnHandler:  nil,
+		StreamClient: streamClient,
+		options:      options,
+		stateLock:    &sync.RWMutex{},
+		goAwayAcked:  make(chan struct{}),
+		draining:     make(chan struct{}),
+		closed:       make(chan struct{}),
+		lastActive:   time.Now().UnixNano(),
 	}
 
-	if connHandler, err := getTcpConn(pcpConnectionHandler.OnData, func(error) {
+	if connHandler, err := getTcpConn(pcpConnectionHandler.OnData, func(err error) {
+		if err != nil {
+			pcpConnectionHandler.setLastError(err)
+		}
 		pcpConnectionHandler.Clean()
 	}); err != nil {
 		return nil, err
@@ -52,6 +90,9 @@ func GetPcpConnectionHandlerFromTcpConn(t int, generateSandbox GenerateSandbox,
 		if t == 1 {
 			go connHandler.ReadFromConn()
 		}
+		if options.HeartbeatInterval > 0 {
+			go pcpConnectionHandler.heartbeat(options.HeartbeatInterval, options.HeartbeatMaxMissed)
+		}
 		return pcpConnectionHandler, nil
 	}
 }
@@ -64,24 +105,52 @@ type ConnectionEvent struct {
 
 type OnConnectedHandler = func(*PCPConnectionHandler)
 
+// options of pcp rpc server
+type ServerOptions struct {
+	ConnectionOptions
+	// close connections without activity and in-flight calls in this duration, never when it is 0.
+	// OnClose of ConnectionEvent receives ErrIdleTimeout.
+	IdleTimeout time.Duration
+}
+
 // build pcp rpc server based on the tcp server itself
-func GetPCPRPCServer(port int, generateSandbox GenerateSandbox, cer func() *ConnectionEvent) (*goaio.TcpServer, error) {
+func GetPCPRPCServer(port int, generateSandbox GenerateSandbox, cer func() *ConnectionEvent) (*PCPRPCServer, error) {
+	return GetPCPRPCServerWithOptions(port, generateSandbox, cer, ServerOptions{})
+}
+
+func GetPCPRPCServerWithOptions(port int, generateSandbox GenerateSandbox, cer func() *ConnectionEvent, options ServerOptions) (*PCPRPCServer, error) {
+	server := &PCPRPCServer{topics: GetTopicBroker()}
+
 	if tcpServer, err := goaio.GetTcpServer(port, func(conn net.Conn) goaio.ConnectionHandler {
 		var connHandler goaio.ConnectionHandler
+		var pcpConnectionHandler *PCPConnectionHandler
 		var ce *ConnectionEvent = nil
 		if cer != nil {
 			ce = cer()
 		}
 
-		pcpConnectionHandler, _ := GetPcpConnectionHandlerFromTcpConn(0, generateSandbox, func(onData goaio.BytesReadHandler, onClose goaio.OnCloseHandler) (goaio.ConnectionHandler, error) {
+		// tcp server reads from its own copy of connection handler, close handler could be called twice
+		var closeOnce sync.Once
+
+		pcpConnectionHandler, _ = getPcpConnectionHandler(0, generateSandbox, func(onData goaio.BytesReadHandler, onClose goaio.OnCloseHandler) (goaio.ConnectionHandler, error) {
 			connHandler = goaio.GetConnectionHandler(conn, onData, func(err error) {
-				if ce != nil {
-					ce.OnClose(err)
-				}
-				onClose(err)
+				closeOnce.Do(func() {
+					server.removeConnection(pcpConnectionHandler)
+					if ce != nil {
+						ce.OnClose(err)
+					}
+					onClose(err)
+				})
 			})
 			return connHandler, nil
-		})
+		}, options.ConnectionOptions)
+
+		pcpConnectionHandler.topics = server.topics
+		server.addConnection(pcpConnectionHandler)
+
+		if options.IdleTimeout > 0 {
+			go pcpConnectionHandler.closeWhenIdle(options.IdleTimeout)
+		}
 
 		if ce != nil {
 			go ce.OnConnected(pcpConnectionHandler)
@@ -91,49 +160,187 @@ func GetPCPRPCServer(port int, generateSandbox GenerateSandbox, cer func() *Conn
 	}); err != nil {
 		return nil, err
 	} else {
+		server.TcpServer = tcpServer
 		go tcpServer.Accepts()
-		return tcpServer, err
+		return server, err
 	}
 }
 
 // build pcp client based on the tcp client itself
 func GetPCPRPCClient(host string, port int, generateSandbox GenerateSandbox, onClose goaio.OnCloseHandler) (*PCPConnectionHandler, error) {
-	return GetPcpConnectionHandlerFromTcpConn(1, generateSandbox, func(onData goaio.BytesReadHandler, closeHandle goaio.OnCloseHandler) (goaio.ConnectionHandler, error) {
-		return goaio.GetTcpClient(host, port, onData, func(err error) {
+	return GetPCPRPCClientWithOptions(host, port, generateSandbox, onClose, ConnectionOptions{})
+}
+
+func GetPCPRPCClientWithOptions(host string, port int, generateSandbox GenerateSandbox, onClose goaio.OnCloseHandler, options ConnectionOptions) (*PCPConnectionHandler, error) {
+	return getPcpConnectionHandler(1, generateSandbox, func(onData goaio.BytesReadHandler, closeHandle goaio.OnCloseHandler) (goaio.ConnectionHandler, error) {
+		return goaio.GetTcpClient(dialHost(host), port, onData, func(err error) {
 			closeHandle(err)
 			if onClose != nil {
 				onClose(err)
 			}
 		})
-	})
+	}, options)
 }
 
 // return host and port
 type GetAddress = func() (string, int, error)
 
 // build pcp pool based on the tcp client
-func GetPCPRPCPool(getAddress GetAddress, generateSandbox GenerateSandbox, poolSize int, duration time.Duration, retryDuration time.Duration) *gopool.Pool {
+func GetPCPRPCPool(getAddress GetAddress, generateSandbox GenerateSandbox, poolSize int, duration time.Duration, retryDuration time.Duration) *PCPRPCPool {
+	return GetPCPRPCPoolWithOptions(getAddress, generateSandbox, poolSize, duration, retryDuration, PoolOptions{})
+}
+
+// connections missing heartbeats are closed, then marked broken in pool
+func GetPCPRPCPoolWithOptions(getAddress GetAddress, generateSandbox GenerateSandbox, poolSize int, duration time.Duration, retryDuration time.Duration, options PoolOptions) *PCPRPCPool {
+	return getPCPRPCPool(getAddress, generateSandbox, poolSize, duration, retryDuration, options)
+}
+
+// connections follow endpoint changes of resolver,
+// connections to removed endpoints are replaced, then closed after in-flight calls finished.
+// when endpoints are added, some connections of crowded endpoints are replaced by connections to them in the same way.
+func GetPCPRPCPoolFromResolver(resolver Resolver, generateSandbox GenerateSandbox, poolSize int, duration time.Duration, retryDuration time.Duration, options PoolOptions) (*PCPRPCPool, error) {
+	endpoints, err := resolver.Resolve()
+	if err != nil {
+		return nil, err
+	}
+
+	address := &resolverAddress{endpoints: endpoints}
+	pool := getPCPRPCPool(address.getAddress, generateSandbox, poolSize, duration, retryDuration, options)
+
+	pool.stopWatch = resolver.Watch(endpoints, func(endpoints []Endpoint) {
+		added := address.update(endpoints)
+		pool.connections.Range(func(_, value interface{}) bool {
+			connection := value.(*poolConnection)
+			if !address.contains(connection.endpoint) {
+				log.Printf("endpoint removed, rotate connection. endpoint=%s\n", connection.endpoint)
+				connection.itemBroken()
+				go connection.handler.closeWhenDrained()
+			}
+			return true
+		})
+		if len(added) > 0 {
+			pool.rebalance(address)
+		}
+	})
+
+	return pool, nil
+}
+
+// rotate connections of endpoints above their share, replacements are dialed to endpoints below it
+func (pool *PCPRPCPool) rebalance(address *resolverAddress) {
+	endpoints := address.list()
+	if len(endpoints) == 0 {
+		return
+	}
+
+	byEndpoint := map[Endpoint][]*poolConnection{}
+	total := 0
+	pool.connections.Range(func(_, value interface{}) bool {
+		connection := value.(*poolConnection)
+		if !connection.overflow && connection.isHealthy() && address.contains(connection.endpoint) {
+			byEndpoint[connection.endpoint] = append(byEndpoint[connection.endpoint], connection)
+			total++
+		}
+		return true
+	})
+
+	// one entry per missing connection
+	var lacking []Endpoint
+	for _, endpoint := range endpoints {
+		for i := len(byEndpoint[endpoint]); i < total/len(endpoints); i++ {
+			lacking = append(lacking, endpoint)
+		}
+	}
+
+	limit := (total + len(endpoints) - 1) / len(endpoints)
+	for _, endpoint := range endpoints {
+		for _, connection := range byEndpoint[endpoint] {
+			if len(lacking) == 0 {
+				return
+			}
+			if len(byEndpoint[endpoint]) <= limit {
+				break
+			}
+			byEndpoint[endpoint] = byEndpoint[endpoint][1:]
+			address.prefer(lacking[0])
+			lacking = lacking[1:]
+
+			log.Printf("endpoint added, rotate connection. endpoint=%s\n", connection.endpoint)
+			connection.itemBroken()
+			go connection.handler.closeWhenDrained()
+		}
+	}
+}
+
+func getPCPRPCPool(getAddress GetAddress, generateSandbox GenerateSandbox, poolSize int, duration time.Duration, retryDuration time.Duration, options PoolOptions) *PCPRPCPool {
+	pool := &PCPRPCPool{
+		getAddress:      getAddress,
+		generateSandbox: generateSandbox,
+		options:         options,
+		size:            poolSize,
+		retrier:         newRetrier(options.Retry),
+	}
+
 	getNewItem := func(onItemBoken gopool.OnItemBorken) (*gopool.Item, error) {
-		if host, port, err := getAddress(); err != nil {
+		if connection, err := pool.dial(false, onItemBoken); err != nil {
 			return nil, err
 		} else {
-			if pcpConnectionHandler, err := GetPcpConnectionHandlerFromTcpConn(1, generateSandbox, func(onData goaio.BytesReadHandler, closeHandle goaio.OnCloseHandler) (goaio.ConnectionHandler, error) {
-				return goaio.GetTcpClient(host, port, onData, func(err error) {
-					log.Printf("connection closed! remote-host=%s, remote-port=%s, errMsg=%s\n", host, strconv.Itoa(port), err)
-					closeHandle(err)
-					onItemBoken()
-				})
-			}); err != nil {
-				log.Printf("connect failed! host=%s, port=%s, errMsg=%s\n", host, strconv.Itoa(port), err)
-				return nil, err
-			} else {
-				log.Printf("connected host=%s, port=%s\n", host, strconv.Itoa(port))
-				return &gopool.Item{pcpConnectionHandler, func() {
-					pcpConnectionHandler.Close()
-				}}, nil
-			}
+			return &gopool.Item{Resouce: connection.handler, Clean: func() {
+				connection.handler.Close()
+			}}, nil
 		}
 	}
 
-	return gopool.GetPool(getNewItem, poolSize, duration, retryDuration)
+	pool.Pool = gopool.GetPool(getNewItem, poolSize, duration, retryDuration)
+	return pool
+}
+
+// connect to an address, onBroken is called once when connection is going away or closed
+func (pool *PCPRPCPool) dial(overflow bool, onBroken func()) (*poolConnection, error) {
+	if host, port, err := pool.getAddress(); err != nil {
+		pool.setDialError(err)
+		return nil, err
+	} else {
+		connection := &poolConnection{endpoint: Endpoint{host, port}, overflow: overflow}
+
+		// connection is removed from pool when it is going away or closed, whichever comes first
+		var brokenOnce sync.Once
+		connection.itemBroken = func() {
+			brokenOnce.Do(func() {
+				atomic.StoreInt32(&connection.broken, 1)
+				onBroken()
+			})
+		}
+
+		if pcpConnectionHandler, err := getPcpConnectionHandler(1, pool.generateSandbox, func(onData goaio.BytesReadHandler, closeHandle goaio.OnCloseHandler) (goaio.ConnectionHandler, error) {
+			return goaio.GetTcpClient(dialHost(host), port, onData, func(err error) {
+				log.Printf("connection closed! remote-host=%s, remote-port=%s, errMsg=%s\n", host, strconv.Itoa(port), err)
+				closeHandle(err)
+				connection.itemBroken()
+			})
+		}, pool.options.ConnectionOptions); err != nil {
+			log.Printf("connect failed! host=%s, port=%s, errMsg=%s\n", host, strconv.Itoa(port), err)
+			pool.setDialError(err)
+			return nil, err
+		} else {
+			log.Printf("connected host=%s, port=%s\n", host, strconv.Itoa(port))
+			pool.setDialError(nil)
+			pcpConnectionHandler.breaker = pool.getBreaker(connection.endpoint)
+
+			// stop lending it to new callers and replace it with a fresh one,
+			// in-flight calls keep going until remote closes the connection after drained
+			pcpConnectionHandler.OnGoAway(func() {
+				log.Printf("remote is going away, rotate connection. host=%s, port=%s\n", host, strconv.Itoa(port))
+				connection.itemBroken()
+			})
+
+			connection.handler = pcpConnectionHandler
+			connection.connectedAt = time.Now()
+			pool.connections.Store(pcpConnectionHandler, connection)
+			pcpConnectionHandler.OnClose(func() {
+				pool.connections.Delete(pcpConnectionHandler)
+			})
+			return connection, nil
+		}
+	}
 }
@@ -0,0 +1,238 @@
+package gopcp_rpc
+
+import (
+	"context"
+	"errors"
+	"github.com/lock-free/gopcp"
+	"github.com/lock-free/gopool"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const DEFAULT_POOL_CALL_TIMEOUT = 10 * time.Second
+
+type PoolOptions struct {
+	ConnectionOptions
+	// timeout of call when the given one is not positive, DEFAULT_POOL_CALL_TIMEOUT by default
+	Timeout time.Duration
+	// calls fail fast with ErrCircuitOpen when breaker of the endpoint is open, nil to disable
+	Breaker *BreakerOptions
+	// retry policy of pool.Call and pool.CallRemote, nil to disable
+	Retry *RetryPolicy
+	// hedging of idempotent functions, nil to disable
+	Hedge *HedgePolicy
+	// calls in flight per connection, a connection reaching it is saturated, 0 means unlimited
+	MaxConcurrentCalls int
+	// connections opened beyond pool size when all connections are saturated
+	MaxOverflow int
+	// overflow connections are closed after idle for it, DEFAULT_OVERFLOW_IDLE_TIMEOUT by default
+	OverflowIdleTimeout time.Duration
+}
+
+// pcp connection pool
+type PCPRPCPool struct {
+	*gopool.Pool
+	getAddress      GetAddress
+	generateSandbox GenerateSandbox
+	options         PoolOptions
+	size            int
+	connections     sync.Map // *PCPConnectionHandler -> *poolConnection, until connection closed
+	breakers        sync.Map // Endpoint -> *CircuitBreaker
+	retrier         *retrier
+	stopWatch       func()
+	overflow        int32 // opened overflow connections
+
+	errLock   sync.Mutex
+	dialError error // last failure of connecting, cleared when connected
+}
+
+// connection in pool
+type poolConnection struct {
+	handler     *PCPConnectionHandler
+	endpoint    Endpoint
+	connectedAt time.Time
+	broken      int32  // removed from pool, but maybe not closed yet
+	overflow    bool   // opened beyond pool size, not managed by gopool
+	itemBroken  func() // remove from pool and replace it with a new one
+}
+
+func (c *poolConnection) isHealthy() bool {
+	return atomic.LoadInt32(&c.broken) == 0 && !c.handler.IsGoingAway() && !c.handler.isClosed()
+}
+
+// connections to the same endpoint share one breaker
+func (p *PCPRPCPool) getBreaker(endpoint Endpoint) *CircuitBreaker {
+	if p.options.Breaker == nil {
+		return nil
+	}
+	breaker, _ := p.breakers.LoadOrStore(endpoint, GetCircuitBreaker(*p.options.Breaker))
+	return breaker.(*CircuitBreaker)
+}
+
+// state of circuit breaker of every connected endpoint
+func (p *PCPRPCPool) BreakerStates() map[Endpoint]BreakerState {
+	states := map[Endpoint]BreakerState{}
+	p.breakers.Range(func(key, value interface{}) bool {
+		states[key.(Endpoint)] = value.(*CircuitBreaker).State()
+		return true
+	})
+	return states
+}
+
+var ErrNoHealthyConnection = errors.New("no healthy connection in pool.")
+
+// healthy connection from pool, connections going away or closed are skipped
+func (p *PCPRPCPool) Get() (*PCPConnectionHandler, error) {
+	return p.getConnection(nil)
+}
+
+// prefer healthy connections which are not used, picks randomly like gopool.
+// connections of endpoints with open circuit breaker are skipped.
+func (p *PCPRPCPool) getConnection(used map[*PCPConnectionHandler]bool) (*PCPConnectionHandler, error) {
+	var healthy, unused []*PCPConnectionHandler
+	open := false
+	p.connections.Range(func(_, value interface{}) bool {
+		connection := value.(*poolConnection)
+		if connection.isHealthy() {
+			if connection.handler.breaker != nil && !connection.handler.breaker.Ready() {
+				open = true
+				return true
+			}
+			healthy = append(healthy, connection.handler)
+			if !used[connection.handler] {
+				unused = append(unused, connection.handler)
+			}
+		}
+		return true
+	})
+
+	candidates := unused
+	if len(candidates) == 0 {
+		candidates = healthy
+	}
+	if len(candidates) == 0 && open {
+		return nil, ErrCircuitOpen
+	}
+	if len(candidates) == 0 {
+		return nil, ErrNoHealthyConnection
+	}
+	if p.options.MaxConcurrentCalls > 0 {
+		return p.getUnsaturated(candidates), nil
+	}
+	return candidates[rand.Intn(len(candidates))], nil
+}
+
+func (p *PCPRPCPool) timeout(timeout time.Duration) time.Duration {
+	if timeout > 0 {
+		return timeout
+	}
+	if p.options.Timeout > 0 {
+		return p.options.Timeout
+	}
+	return DEFAULT_POOL_CALL_TIMEOUT
+}
+
+// connections used by attempts of one call, shared by hedged attempts
+type usedConnections struct {
+	lock     sync.Mutex
+	handlers map[*PCPConnectionHandler]bool
+}
+
+func (p *PCPRPCPool) pickUnused(used *usedConnections) (*PCPConnectionHandler, error) {
+	used.lock.Lock()
+	defer used.lock.Unlock()
+
+	handler, err := p.getConnection(used.handlers)
+	if err == nil {
+		used.handlers[handler] = true
+	}
+	return handler, err
+}
+
+// call on a connection, when request could not be sent over a broken or going away connection, try another one
+func (p *PCPRPCPool) withConnection(used *usedConnections, call func(*PCPConnectionHandler) (interface{}, error)) (interface{}, error) {
+	var lastErr error
+	for i := 0; i <= p.GetItemNum(); i++ {
+		handler, err := p.pickUnused(used)
+		if err != nil {
+			if lastErr != nil {
+				return nil, lastErr
+			}
+			return nil, err
+		}
+
+		ret, err := call(handler)
+		// request was not sent, also when goaway arrived after the connection was picked
+		if !isSendError(err) && err != ErrGoingAway {
+			return ret, err
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+// call with a connection from pool, every retry takes a connection again
+func (p *PCPRPCPool) CallRemote(command string, timeout time.Duration) (interface{}, error) {
+	return p.CallRemoteContext(context.Background(), command, timeout)
+}
+
+func (p *PCPRPCPool) CallRemoteContext(ctx context.Context, command string, timeout time.Duration) (interface{}, error) {
+	timeout = p.timeout(timeout)
+	return p.retrier.call(command, func() (interface{}, error) {
+		used := &usedConnections{handlers: map[*PCPConnectionHandler]bool{}}
+
+		return hedge(ctx, p.options.Hedge, command, func(ctx context.Context, n int) (interface{}, error) {
+			return p.withConnection(used, func(handler *PCPConnectionHandler) (interface{}, error) {
+				return handler.CallRemoteContext(ctx, command, timeout)
+			})
+		})
+	})
+}
+
+func (p *PCPRPCPool) Call(list gopcp.CallResult, timeout time.Duration) (interface{}, error) {
+	return p.CallContext(context.Background(), list, timeout)
+}
+
+func (p *PCPRPCPool) CallContext(ctx context.Context, list gopcp.CallResult, timeout time.Duration) (interface{}, error) {
+	pcpClient := gopcp.PcpClient{}
+	if cmdText, err := pcpClient.ToJSON(list); err != nil {
+		return nil, err
+	} else {
+		return p.CallRemoteContext(ctx, cmdText, timeout)
+	}
+}
+
+// call stream function, the last param is the stream callback, eg:
+// pool.StreamCall(time.Second, "streamApi", "seed", func(t int, d interface{}) {})
+// stream calls are neither retried nor hedged, except that request could not be sent
+func (p *PCPRPCPool) StreamCall(timeout time.Duration, streamFunName string, params ...interface{}) (interface{}, error) {
+	timeout = p.timeout(timeout)
+	return p.withConnection(&usedConnections{handlers: map[*PCPConnectionHandler]bool{}}, func(handler *PCPConnectionHandler) (interface{}, error) {
+		if exp, err := handler.StreamCall(streamFunName, params...); err != nil {
+			return nil, err
+		} else {
+			return handler.Call(*exp, timeout)
+		}
+	})
+}
+
+func (p *PCPRPCPool) RetryStats() RetryStats {
+	return p.retrier.Stats()
+}
+
+func (p *PCPRPCPool) Shutdown() {
+	if p.stopWatch != nil {
+		p.stopWatch()
+	}
+	p.Pool.Shutdown()
+
+	// overflow connections are not managed by gopool
+	p.connections.Range(func(_, value interface{}) bool {
+		if connection := value.(*poolConnection); connection.overflow {
+			connection.handler.Close()
+		}
+		return true
+	})
+}
@@ -0,0 +1,95 @@
+package gopcp_rpc
+
+import (
+	"context"
+	"github.com/lock-free/goaio"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// interval to check whether connections are drained when shutting down
+var shutdownPollInterval = 10 * time.Millisecond
+
+// wait for goaway ack of peers which never sent a control package
+var goAwayAckWait = time.Second
+
+// pcp rpc server, wrapping the tcp server with live connections
+type PCPRPCServer struct {
+	*goaio.TcpServer
+	connections  sync.Map // *PCPConnectionHandler -> struct{}
+	byId         sync.Map // connection id -> *PCPConnectionHandler
+	topics       *TopicBroker
+	shuttingDown int32
+}
+
+func (s *PCPRPCServer) addConnection(pcpConnectionHandler *PCPConnectionHandler) {
+	s.connections.Store(pcpConnectionHandler, struct{}{})
+	s.byId.Store(pcpConnectionHandler.Id(), pcpConnectionHandler)
+
+	// connection accepted while shutting down, drain it too
+	if atomic.LoadInt32(&s.shuttingDown) == 1 {
+		pcpConnectionHandler.GoAway()
+	}
+}
+
+func (s *PCPRPCServer) removeConnection(pcpConnectionHandler *PCPConnectionHandler) {
+	s.connections.Delete(pcpConnectionHandler)
+	s.byId.Delete(pcpConnectionHandler.Id())
+}
+
+func (s *PCPRPCServer) rangeConnections(fn func(*PCPConnectionHandler)) {
+	s.connections.Range(func(key, value interface{}) bool {
+		fn(key.(*PCPConnectionHandler))
+		return true
+	})
+}
+
+// graceful shutdown:
+// (1) stop accepting new connections
+// (2) send goaway to clients, clients stop sending new requests and ack it
+// (3) wait for in-flight requests to finish, then close the connection
+// when ctx expired, close the remaining connections and return ctx error.
+func (s *PCPRPCServer) Shutdown(ctx context.Context) error {
+	atomic.StoreInt32(&s.shuttingDown, 1)
+	s.TcpServer.Close()
+
+	s.rangeConnections(func(pcpConnectionHandler *PCPConnectionHandler) {
+		pcpConnectionHandler.GoAway()
+	})
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+
+	for {
+		if s.closeDrainedConnections() {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			s.rangeConnections(func(pcpConnectionHandler *PCPConnectionHandler) {
+				pcpConnectionHandler.Close()
+			})
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// returns true when all connections are closed
+func (s *PCPRPCServer) closeDrainedConnections() bool {
+	allClosed := true
+	s.rangeConnections(func(pcpConnectionHandler *PCPConnectionHandler) {
+		// for connections accepted in shutting down process
+		pcpConnectionHandler.GoAway()
+
+		if pcpConnectionHandler.isDrained() {
+			pcpConnectionHandler.Close()
+			s.removeConnection(pcpConnectionHandler)
+		} else {
+			allClosed = false
+		}
+	})
+	return allClosed
+}
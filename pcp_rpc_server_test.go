@@ -0,0 +1,260 @@
+package gopcp_rpc
+
+import (
+	"context"
+	"github.com/lock-free/goaio"
+	"github.com/lock-free/gopcp"
+	"github.com/lock-free/gopcp_stream"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func sleepSandbox(streamServer *gopcp_stream.StreamServer) *gopcp.Sandbox {
+	return gopcp.GetSandbox(map[string]*gopcp.BoxFunc{
+		"sleep": gopcp.ToSandboxFun(func(args []interface{}, attachment interface{}, pcpServer *gopcp.PcpServer) (interface{}, error) {
+			time.Sleep(time.Duration(args[0].(float64)) * time.Millisecond)
+			return "done", nil
+		}),
+	})
+}
+
+func TestShutdownDrain(t *testing.T) {
+	server, err := GetPCPRPCServer(0, sleepSandbox, nil)
+	if err != nil {
+		t.Fatalf("fail to start server, %v", err)
+	}
+
+	closed := make(chan struct{})
+	client, err := GetPCPRPCClient("127.0.0.1", server.GetPort(), sleepSandbox, func(error) {
+		close(closed)
+	})
+	if err != nil {
+		t.Fatalf("fail to connect, %v", err)
+	}
+
+	count := 20
+	var wg sync.WaitGroup
+	wg.Add(count)
+	for i := 0; i < count; i++ {
+		go func() {
+			defer wg.Done()
+			ret, err := client.CallRemote(`["sleep", 100]`, 5*time.Second)
+			if err != nil {
+				t.Errorf("in-flight call should finish, %v", err)
+			} else {
+				assertEqual(t, ret, "done", "")
+			}
+		}()
+	}
+
+	time.Sleep(30 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assertEqual(t, server.Shutdown(ctx), nil, "")
+	wg.Wait()
+
+	// connection is closed by server after drained
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatalf("connection should be closed after drained")
+	}
+
+	assertEqual(t, client.IsGoingAway(), true, "")
+	_, err = client.CallRemote(`["sleep", 1]`, time.Second)
+	assertEqual(t, err, ErrGoingAway, "")
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	server, err := GetPCPRPCServer(0, sleepSandbox, nil)
+	if err != nil {
+		t.Fatalf("fail to start server, %v", err)
+	}
+
+	client, err := GetPCPRPCClient("127.0.0.1", server.GetPort(), sleepSandbox, nil)
+	if err != nil {
+		t.Fatalf("fail to connect, %v", err)
+	}
+	go client.CallRemote(`["sleep", 2000]`, 5*time.Second)
+
+	time.Sleep(30 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assertEqual(t, server.Shutdown(ctx), context.DeadlineExceeded, "")
+}
+
+func TestIdleTimeout(t *testing.T) {
+	closeErr := make(chan error, 1)
+	server, err := GetPCPRPCServerWithOptions(0, sleepSandbox, func() *ConnectionEvent {
+		return &ConnectionEvent{
+			OnConnected: func(*PCPConnectionHandler) {},
+			OnClose: func(err error) {
+				closeErr <- err
+			},
+		}
+	}, ServerOptions{IdleTimeout: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("fail to start server, %v", err)
+	}
+	defer server.Close()
+
+	// heartbeats do not keep connection alive
+	client, err := GetPCPRPCClientWithOptions("127.0.0.1", server.GetPort(), sleepSandbox, nil, ConnectionOptions{
+		HeartbeatInterval: 10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("fail to connect, %v", err)
+	}
+
+	// connection with in-flight call is not idle
+	ret, err := client.CallRemote(`["sleep", 150]`, time.Second)
+	assertEqual(t, err, nil, "")
+	assertEqual(t, ret, "done", "")
+
+	select {
+	case err := <-closeErr:
+		assertEqual(t, err, ErrIdleTimeout, "")
+	case <-time.After(time.Second):
+		t.Fatalf("idle connection should be closed")
+	}
+
+	if _, err = client.CallRemote(`["sleep", 1]`, time.Second); err == nil {
+		t.Errorf("call should fail after connection closed")
+	}
+}
+
+func TestIdleTimeoutOpenStream(t *testing.T) {
+	closeErr := make(chan error, 1)
+	server, err := GetPCPRPCServerWithOptions(0, func(streamServer *gopcp_stream.StreamServer) *gopcp.Sandbox {
+		return gopcp.GetSandbox(map[string]*gopcp.BoxFunc{
+			// returns at once, items are sent later with gaps longer than idle timeout
+			"slowStream": streamServer.StreamApi(func(
+				streamProducer gopcp_stream.StreamProducer,
+				args []interface{},
+				attachment interface{},
+				pcpServer *gopcp.PcpServer,
+			) (interface{}, error) {
+				go func() {
+					for i := 0; i < 2; i++ {
+						streamProducer.SendData(i, time.Second)
+						time.Sleep(150 * time.Millisecond)
+					}
+					streamProducer.SendEnd(time.Second)
+				}()
+				return nil, nil
+			}),
+		})
+	}, func() *ConnectionEvent {
+		return &ConnectionEvent{
+			OnConnected: func(*PCPConnectionHandler) {},
+			OnClose: func(err error) {
+				closeErr <- err
+			},
+		}
+	}, ServerOptions{IdleTimeout: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("fail to start server, %v", err)
+	}
+	defer server.Close()
+
+	client, err := GetPCPRPCClient("127.0.0.1", server.GetPort(), sleepSandbox, nil)
+	if err != nil {
+		t.Fatalf("fail to connect, %v", err)
+	}
+
+	// connection with open stream is not idle
+	stream, err := client.Stream(context.Background(), time.Second, "slowStream")
+	assertEqual(t, err, nil, "")
+	items := []interface{}{}
+	for item := range stream.C {
+		items = append(items, item)
+	}
+	assertEqual(t, stream.Err(), nil, "")
+	assertEqual(t, len(items), 2, "")
+	assertEqual(t, items[0], 0.0, "")
+	assertEqual(t, items[1], 1.0, "")
+
+	select {
+	case err := <-closeErr:
+		assertEqual(t, err, ErrIdleTimeout, "")
+	case <-time.After(time.Second):
+		t.Fatalf("idle connection should be closed")
+	}
+}
+
+func TestShutdownPeersWithoutAck(t *testing.T) {
+	ackWait := goAwayAckWait
+	goAwayAckWait = 50 * time.Millisecond
+	defer func() { goAwayAckWait = ackWait }()
+
+	server, err := GetPCPRPCServerWithOptions(0, simpleSandbox, nil, ServerOptions{ConnectionOptions: ConnectionOptions{JSONRPC: true}})
+	if err != nil {
+		t.Fatalf("fail to start server, %v", err)
+	}
+
+	// json-rpc peer and older peer, both of them never ack goaway
+	p := GetPackageProtocol()
+	responses := make(chan string, 1)
+	jsonRPCConn, err := goaio.GetTcpClient("127.0.0.1", server.GetPort(), func(data []byte) {
+		for _, text := range p.GetPktText(data) {
+			responses <- text
+		}
+	}, func(error) {})
+	if err != nil {
+		t.Fatalf("fail to connect, %v", err)
+	}
+	go jsonRPCConn.ReadFromConn()
+	defer jsonRPCConn.Close(nil)
+	p.SendPackage(&jsonRPCConn, `{"jsonrpc": "2.0", "method": "add", "params": [1, 2], "id": 1}`)
+	<-responses
+
+	olderConn, err := net.Dial("tcp", "127.0.0.1:"+strconv.Itoa(server.GetPort()))
+	if err != nil {
+		t.Fatalf("fail to connect, %v", err)
+	}
+	defer olderConn.Close()
+	time.Sleep(20 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	start := time.Now()
+	assertEqual(t, server.Shutdown(ctx), nil, "")
+	if time.Since(start) > time.Second {
+		t.Errorf("peers without ack should be drained once nothing is in flight")
+	}
+}
+
+func TestGoAwayAckFailureClosesConnection(t *testing.T) {
+	// peer which never writes nor closes, only sending of client fails
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("fail to listen, %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err == nil {
+			defer conn.Close()
+			time.Sleep(5 * time.Second)
+		}
+	}()
+
+	client, err := GetPCPRPCClient("127.0.0.1", ln.Addr().(*net.TCPAddr).Port, simpleSandbox, nil)
+	if err != nil {
+		t.Fatalf("fail to connect, %v", err)
+	}
+	client.ConnHandler.Conn.(*net.TCPConn).CloseWrite()
+
+	go client.onGoAway()
+	select {
+	case <-client.closed:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("connection should be closed after failing to send goaway ack")
+	}
+	assertEqual(t, client.IsGoingAway(), true, "")
+}
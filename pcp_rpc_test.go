@@ -1,6 +1,7 @@
 package gopcp_rpc
 
 import (
+	"context"
 	"errors"
 	"github.com/lock-free/gopcp"
 	"github.com/lock-free/gopcp_stream"
@@ -116,10 +117,8 @@ func testPCPRPCPool(expectFail bool, t *testing.T, callResult gopcp.CallResult,
 	runClient := func() {
 		defer wg.Done()
 		// pickup a client
-		if item, err := pool.Get(); err != nil {
+		if client, err := pool.Get(); err != nil {
 			t.Errorf("fail to get item from pool, %v", err)
-		} else if client, ok := item.(*PCPConnectionHandler); !ok {
-			t.Errorf("can not convert client")
 		} else if ret, err := client.Call(callResult, timeout); err != nil && !expectFail {
 			t.Errorf("call errored, %v", err)
 		} else {
@@ -271,3 +270,136 @@ func TestOnConnected(t *testing.T) {
 	wg.Wait()
 	assertEqual(t, sum, 4.0*float64(count), "")
 }
+
+func TestPoolGoAwayRotation(t *testing.T) {
+	server1, err := GetPCPRPCServer(0, sleepSandbox, nil)
+	if err != nil {
+		t.Fatalf("fail to start server, %v", err)
+	}
+	server2, err := GetPCPRPCServer(0, sleepSandbox, nil)
+	if err != nil {
+		t.Fatalf("fail to start server, %v", err)
+	}
+	defer server2.Close()
+
+	var portLock sync.Mutex
+	port := server1.GetPort()
+
+	pool := GetPCPRPCPool(func() (string, int, error) {
+		portLock.Lock()
+		defer portLock.Unlock()
+		return "127.0.0.1", port, nil
+	}, sleepSandbox, 4, 10*time.Millisecond, 10*time.Millisecond)
+	defer pool.Shutdown()
+
+	time.Sleep(100 * time.Millisecond)
+	assertEqual(t, pool.GetItemNum(), 4, "")
+
+	// in-flight calls on draining connections should finish
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		client, _ := pool.Get()
+		wg.Add(1)
+		go func(client *PCPConnectionHandler) {
+			defer wg.Done()
+			if _, err := client.CallRemote(`["sleep", 100]`, 5*time.Second); err != nil {
+				t.Errorf("in-flight call should finish, %v", err)
+			}
+		}(client)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	portLock.Lock()
+	port = server2.GetPort()
+	portLock.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assertEqual(t, server1.Shutdown(ctx), nil, "")
+	wg.Wait()
+
+	time.Sleep(100 * time.Millisecond)
+	assertEqual(t, pool.GetItemNum(), 4, "")
+	for i := 0; i < 20; i++ {
+		client, _ := pool.Get()
+		assertEqual(t, client.IsGoingAway(), false, "")
+		if _, err := client.CallRemote(`["sleep", 1]`, time.Second); err != nil {
+			t.Errorf("call should succeed after rotation, %v", err)
+		}
+	}
+}
+
+func TestPoolCallAndStreamCall(t *testing.T) {
+	server, err := GetPCPRPCServer(0, func(streamServer *gopcp_stream.StreamServer) *gopcp.Sandbox {
+		return gopcp.GetSandbox(map[string]*gopcp.BoxFunc{
+			"add": gopcp.ToSandboxFun(func(args []interface{}, attachment interface{}, pcpServer *gopcp.PcpServer) (interface{}, error) {
+				return args[0].(float64) + args[1].(float64), nil
+			}),
+			"streamApi": streamServer.StreamApi(func(streamProducer gopcp_stream.StreamProducer, args []interface{}, attachment interface{}, pcpServer *gopcp.PcpServer) (interface{}, error) {
+				streamProducer.SendData(args[0].(string)+"1", 10*time.Second)
+				streamProducer.SendData(args[0].(string)+"2", 10*time.Second)
+				streamProducer.SendEnd(10 * time.Second)
+				return nil, nil
+			}),
+		})
+	}, nil)
+	if err != nil {
+		t.Fatalf("fail to start server, %v", err)
+	}
+	defer server.Close()
+
+	pool := GetPCPRPCPool(func() (string, int, error) {
+		return "127.0.0.1", server.GetPort(), nil
+	}, simpleSandbox, 2, 10*time.Millisecond, 10*time.Millisecond)
+	defer pool.Shutdown()
+	time.Sleep(50 * time.Millisecond)
+
+	// closed connection is never picked
+	client, err := pool.Get()
+	assertEqual(t, err, nil, "")
+	client.Close()
+
+	p := gopcp.PcpClient{}
+	for i := 0; i < 10; i++ {
+		ret, err := pool.Call(p.Call("add", 1, 2), 0)
+		assertEqual(t, err, nil, "")
+		assertEqual(t, ret, 3.0, "")
+	}
+
+	ret := ""
+	_, err = pool.StreamCall(time.Second, "streamApi", "_", func(t int, d interface{}) {
+		if t == gopcp_stream.STREAM_DATA {
+			ret += d.(string)
+		}
+	})
+	assertEqual(t, err, nil, "")
+	assertEqual(t, ret, "_1_2", "")
+}
+
+func TestPoolWithConnectionGoingAway(t *testing.T) {
+	server, err := GetPCPRPCServer(0, simpleSandbox, nil)
+	if err != nil {
+		t.Fatalf("fail to start server, %v", err)
+	}
+	defer server.Close()
+
+	pool := GetPCPRPCPool(func() (string, int, error) {
+		return "127.0.0.1", server.GetPort(), nil
+	}, simpleSandbox, 2, 10*time.Millisecond, 10*time.Millisecond)
+	defer pool.Shutdown()
+	time.Sleep(50 * time.Millisecond)
+
+	// goaway arrives between picking the connection and sending
+	calls := 0
+	used := &usedConnections{handlers: map[*PCPConnectionHandler]bool{}}
+	ret, err := pool.withConnection(used, func(handler *PCPConnectionHandler) (interface{}, error) {
+		calls++
+		if calls == 1 {
+			return nil, ErrGoingAway
+		}
+		return handler.CallRemote(`["add", 1, 2]`, time.Second)
+	})
+	assertEqual(t, err, nil, "")
+	assertEqual(t, ret, 3.0, "")
+	assertEqual(t, calls, 2, "")
+}
@@ -0,0 +1,77 @@
+package gopcp_rpc
+
+import (
+	"log"
+	"math/rand"
+	"sync/atomic"
+	"time"
+)
+
+// connection multiplexing limits
+// a connection with MaxConcurrentCalls in flight is saturated. When all connections are saturated,
+// pool opens overflow connections up to MaxOverflow, which are closed after idle for OverflowIdleTimeout.
+// When overflow is exhausted too, the least busy connection is used.
+
+const DEFAULT_OVERFLOW_IDLE_TIMEOUT = 30 * time.Second
+
+func (p *PCPRPCPool) getUnsaturated(candidates []*PCPConnectionHandler) *PCPConnectionHandler {
+	var unsaturated []*PCPConnectionHandler
+	for _, handler := range candidates {
+		if handler.InFlight() < p.options.MaxConcurrentCalls {
+			unsaturated = append(unsaturated, handler)
+		}
+	}
+	if len(unsaturated) > 0 {
+		return unsaturated[rand.Intn(len(unsaturated))]
+	}
+
+	if handler, ok := p.openOverflow(); ok {
+		return handler
+	}
+
+	leastBusy := candidates[0]
+	for _, handler := range candidates[1:] {
+		if handler.InFlight() < leastBusy.InFlight() {
+			leastBusy = handler
+		}
+	}
+	return leastBusy
+}
+
+func (p *PCPRPCPool) reserveOverflow() bool {
+	for {
+		overflow := atomic.LoadInt32(&p.overflow)
+		if int(overflow) >= p.options.MaxOverflow {
+			return false
+		}
+		if atomic.CompareAndSwapInt32(&p.overflow, overflow, overflow+1) {
+			return true
+		}
+	}
+}
+
+func (p *PCPRPCPool) openOverflow() (*PCPConnectionHandler, bool) {
+	if !p.reserveOverflow() {
+		return nil, false
+	}
+
+	connection, err := p.dial(true, func() {})
+	if err != nil {
+		atomic.AddInt32(&p.overflow, -1)
+		return nil, false
+	}
+	log.Printf("pool saturated, opened overflow connection. endpoint=%s\n", connection.endpoint)
+
+	handler := connection.handler
+	handler.OnClose(func() {
+		atomic.AddInt32(&p.overflow, -1)
+	})
+
+	// shrink back when load drops
+	idleTimeout := p.options.OverflowIdleTimeout
+	if idleTimeout <= 0 {
+		idleTimeout = DEFAULT_OVERFLOW_IDLE_TIMEOUT
+	}
+	go handler.closeWhenIdle(idleTimeout)
+	return handler, true
+}
@@ -0,0 +1,47 @@
+package gopcp_rpc
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPoolOverflow(t *testing.T) {
+	servers, endpoints := testBalancedServers(t, "a")
+	defer servers[0].Close()
+
+	pool := GetPCPRPCPoolWithOptions(func() (string, int, error) {
+		return endpoints[0].Host, endpoints[0].Port, nil
+	}, simpleSandbox, 1, 10*time.Millisecond, 10*time.Millisecond, PoolOptions{
+		MaxConcurrentCalls:  1,
+		MaxOverflow:         2,
+		OverflowIdleTimeout: 50 * time.Millisecond,
+	})
+	defer pool.Shutdown()
+	time.Sleep(30 * time.Millisecond)
+
+	// every call saturates a connection
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := pool.CallRemote(`["sleep", 200]`, time.Second)
+			assertEqual(t, err, nil, "")
+		}()
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	stats := pool.Stats()
+	assertEqual(t, stats.Alive, 3, "")
+	assertEqual(t, stats.Overflow, 2, "")
+	assertEqual(t, stats.Reconnecting, 0, "")
+	assertEqual(t, stats.InFlight, 4, "")
+	wg.Wait()
+
+	// shrink back when load drops
+	time.Sleep(200 * time.Millisecond)
+	stats = pool.Stats()
+	assertEqual(t, stats.Alive, 1, "")
+	assertEqual(t, stats.Overflow, 0, "")
+}
@@ -0,0 +1,115 @@
+package gopcp_rpc
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// stats of pool for introspection, eg: admin pages
+
+type PoolConnectionStats struct {
+	Endpoint      Endpoint      `json:"endpoint"`
+	RemoteAddress string        `json:"remoteAddress"`
+	ConnectedAt   time.Time     `json:"connectedAt"`
+	Age           time.Duration `json:"age"`
+	InFlight      int           `json:"inFlight"`
+	Latency       time.Duration `json:"latency"`
+	// removed from pool, waiting for in-flight calls before closing
+	Broken    bool   `json:"broken"`
+	Overflow  bool   `json:"overflow"`
+	GoingAway bool   `json:"goingAway"`
+	LastError string `json:"lastError,omitempty"`
+}
+
+type PoolStats struct {
+	Size int `json:"size"`
+	// connections lent by pool
+	Alive int `json:"alive"`
+	// alive connections with in-flight calls
+	Busy int `json:"busy"`
+	// connections removed from pool but not closed yet
+	Broken int `json:"broken"`
+	// alive connections opened beyond pool size
+	Overflow int `json:"overflow"`
+	// connections pool is trying to establish
+	Reconnecting  int                   `json:"reconnecting"`
+	InFlight      int                   `json:"inFlight"`
+	LastDialError string                `json:"lastDialError,omitempty"`
+	Breakers      map[string]string     `json:"breakers,omitempty"`
+	Retry         RetryStats            `json:"retry"`
+	Connections   []PoolConnectionStats `json:"connections"`
+}
+
+func (p *PCPRPCPool) setDialError(err error) {
+	p.errLock.Lock()
+	defer p.errLock.Unlock()
+	p.dialError = err
+}
+
+func (p *PCPRPCPool) lastDialError() error {
+	p.errLock.Lock()
+	defer p.errLock.Unlock()
+	return p.dialError
+}
+
+// snapshot of pool, connections are ordered by connected time
+func (p *PCPRPCPool) Stats() PoolStats {
+	now := time.Now()
+	stats := PoolStats{Size: p.size, Retry: p.RetryStats()}
+
+	p.connections.Range(func(_, value interface{}) bool {
+		connection := value.(*poolConnection)
+		handler := connection.handler
+
+		connectionStats := PoolConnectionStats{
+			Endpoint:    connection.endpoint,
+			ConnectedAt: connection.connectedAt,
+			Age:         now.Sub(connection.connectedAt),
+			InFlight:    handler.InFlight(),
+			Latency:     handler.Latency(),
+			Broken:      atomic.LoadInt32(&connection.broken) == 1,
+			GoingAway:   handler.IsGoingAway(),
+			Overflow:    connection.overflow,
+		}
+		if handler.ConnHandler != nil && handler.ConnHandler.Conn != nil {
+			connectionStats.RemoteAddress = handler.ConnHandler.Conn.RemoteAddr().String()
+		}
+		if err := handler.LastError(); err != nil {
+			connectionStats.LastError = err.Error()
+		}
+
+		stats.InFlight += connectionStats.InFlight
+		if connectionStats.Broken {
+			stats.Broken++
+		} else {
+			stats.Alive++
+			if connection.overflow {
+				stats.Overflow++
+			}
+			if connectionStats.InFlight > 0 {
+				stats.Busy++
+			}
+		}
+		stats.Connections = append(stats.Connections, connectionStats)
+		return true
+	})
+
+	if stats.Alive-stats.Overflow < stats.Size {
+		stats.Reconnecting = stats.Size - (stats.Alive - stats.Overflow)
+	}
+	if err := p.lastDialError(); err != nil {
+		stats.LastDialError = err.Error()
+	}
+	for endpoint, state := range p.BreakerStates() {
+		if stats.Breakers == nil {
+			stats.Breakers = map[string]string{}
+		}
+		stats.Breakers[endpoint.String()] = state.String()
+	}
+
+	sort.Slice(stats.Connections, func(i, j int) bool {
+		return stats.Connections[i].ConnectedAt.Before(stats.Connections[j].ConnectedAt)
+	})
+	return stats
+}
@@ -0,0 +1,50 @@
+package gopcp_rpc
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPoolStats(t *testing.T) {
+	servers, endpoints := testBalancedServers(t, "a")
+	server := servers[0]
+
+	pool := GetPCPRPCPool(func() (string, int, error) {
+		return endpoints[0].Host, endpoints[0].Port, nil
+	}, simpleSandbox, 2, 10*time.Millisecond, 10*time.Millisecond)
+	defer pool.Shutdown()
+
+	done := make(chan struct{})
+	go func() {
+		pool.CallRemote(`["sleep", 200]`, time.Second)
+		close(done)
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	stats := pool.Stats()
+	assertEqual(t, stats.Size, 2, "")
+	assertEqual(t, stats.Alive, 2, "")
+	assertEqual(t, stats.Busy, 1, "")
+	assertEqual(t, stats.InFlight, 1, "")
+	assertEqual(t, stats.Reconnecting, 0, "")
+	assertEqual(t, len(stats.Connections), 2, "")
+	for _, connection := range stats.Connections {
+		assertEqual(t, connection.Endpoint, endpoints[0], "")
+		assertEqual(t, strings.HasSuffix(connection.RemoteAddress, ":"+strconv.Itoa(endpoints[0].Port)), true, "")
+		assertEqual(t, connection.Age > 0, true, "")
+	}
+	<-done
+
+	// connections are gone with server, pool keeps trying
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	server.Shutdown(ctx)
+	time.Sleep(100 * time.Millisecond)
+	stats = pool.Stats()
+	assertEqual(t, stats.Alive, 0, "")
+	assertEqual(t, stats.Reconnecting, 2, "")
+	assertEqual(t, stats.LastDialError != "", true, "")
+}
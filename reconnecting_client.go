@@ -0,0 +1,289 @@
+package gopcp_rpc
+
+import (
+	"context"
+	"errors"
+	"github.com/lock-free/goaio"
+	"github.com/lock-free/gopcp"
+	"log"
+	"math/rand"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// client which redials when connection is lost
+// every connection is built with the same sandbox generator, so client-side sandbox is registered again.
+// When remote is going away, client dials a new connection for new calls, in-flight calls keep going on the old one.
+
+type ConnState int
+
+const (
+	CONN_STATE_CONNECTING ConnState = iota
+	CONN_STATE_CONNECTED
+	CONN_STATE_DISCONNECTED
+	CONN_STATE_CLOSED
+)
+
+func (s ConnState) String() string {
+	switch s {
+	case CONN_STATE_CONNECTING:
+		return "connecting"
+	case CONN_STATE_CONNECTED:
+		return "connected"
+	case CONN_STATE_DISCONNECTED:
+		return "disconnected"
+	case CONN_STATE_CLOSED:
+		return "closed"
+	default:
+		return "unknown(" + strconv.Itoa(int(s)) + ")"
+	}
+}
+
+const DEFAULT_RECONNECT_INITIAL_BACKOFF = 100 * time.Millisecond
+const DEFAULT_RECONNECT_MAX_BACKOFF = 30 * time.Second
+const DEFAULT_RECONNECT_JITTER = 0.2
+const DEFAULT_RECONNECT_STABLE_DURATION = 10 * time.Second
+
+var ErrDisconnected = errors.New("client is disconnected.")
+var ErrClientClosed = errors.New("client is closed.")
+
+type ReconnectOptions struct {
+	ConnectionOptions
+	// redial backoff is InitialBackoff * 2^attempt, at most MaxBackoff
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	// backoff is randomized in [1 - Jitter, 1 + Jitter] of itself
+	Jitter float64
+	// backoff starts over only after a connection stayed up this long, so a remote closing connections at once is not redialed in a tight loop
+	StableDuration time.Duration
+	// true: calls wait for reconnecting until their timeout, false: calls fail with ErrDisconnected while disconnected
+	BufferCalls bool
+	// called when state of client changed
+	OnStateChange func(from ConnState, to ConnState)
+}
+
+type ReconnectingClient struct {
+	getAddress      GetAddress
+	generateSandbox GenerateSandbox
+	options         ReconnectOptions
+
+	lock      sync.Mutex
+	state     ConnState
+	handler   *PCPConnectionHandler
+	connected chan struct{} // closed when connected, renewed when disconnected
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func GetReconnectingClient(getAddress GetAddress, generateSandbox GenerateSandbox, options ReconnectOptions) *ReconnectingClient {
+	if options.InitialBackoff <= 0 {
+		options.InitialBackoff = DEFAULT_RECONNECT_INITIAL_BACKOFF
+	}
+	if options.MaxBackoff <= 0 {
+		options.MaxBackoff = DEFAULT_RECONNECT_MAX_BACKOFF
+	}
+	if options.Jitter < 0 || options.Jitter > 1 {
+		options.Jitter = DEFAULT_RECONNECT_JITTER
+	}
+	if options.StableDuration <= 0 {
+		options.StableDuration = DEFAULT_RECONNECT_STABLE_DURATION
+	}
+
+	c := &ReconnectingClient{
+		getAddress:      getAddress,
+		generateSandbox: generateSandbox,
+		options:         options,
+		state:           CONN_STATE_CONNECTING,
+		connected:       make(chan struct{}),
+		closed:          make(chan struct{}),
+	}
+	go c.run()
+	return c
+}
+
+func (c *ReconnectingClient) State() ConnState {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.state
+}
+
+// current connection, nil when disconnected
+func (c *ReconnectingClient) Handler() *PCPConnectionHandler {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.handler
+}
+
+func (c *ReconnectingClient) setState(state ConnState, handler *PCPConnectionHandler) {
+	c.lock.Lock()
+	from := c.state
+	if from == CONN_STATE_CLOSED {
+		c.lock.Unlock()
+		return
+	}
+	c.state = state
+	c.handler = handler
+	if state == CONN_STATE_CONNECTED {
+		close(c.connected)
+	} else if from == CONN_STATE_CONNECTED {
+		c.connected = make(chan struct{})
+	}
+	c.lock.Unlock()
+
+	if from != state && c.options.OnStateChange != nil {
+		c.options.OnStateChange(from, state)
+	}
+}
+
+func (c *ReconnectingClient) run() {
+	attempt := 0
+	for {
+		c.setState(CONN_STATE_CONNECTING, nil)
+
+		handler, lost, err := c.dial()
+		if err != nil {
+			c.setState(CONN_STATE_DISCONNECTED, nil)
+			if !c.sleep(c.backoff(attempt)) {
+				return
+			}
+			attempt++
+			continue
+		}
+
+		connectedAt := time.Now()
+		c.setState(CONN_STATE_CONNECTED, handler)
+
+		select {
+		case <-lost:
+			c.setState(CONN_STATE_DISCONNECTED, nil)
+		case <-c.closed:
+			handler.Close()
+			return
+		}
+
+		// lost connection is also backed off, attempts are counted until a connection is stable
+		if time.Since(connectedAt) >= c.options.StableDuration {
+			attempt = 0
+		}
+		if !c.sleep(c.backoff(attempt)) {
+			return
+		}
+		attempt++
+	}
+}
+
+// lost is notified when connection closed or remote is going away
+func (c *ReconnectingClient) dial() (*PCPConnectionHandler, chan struct{}, error) {
+	host, port, err := c.getAddress()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	lost := make(chan struct{}, 1)
+	notifyLost := func() {
+		select {
+		case lost <- struct{}{}:
+		default:
+		}
+	}
+
+	handler, err := getPcpConnectionHandler(1, c.generateSandbox, func(onData goaio.BytesReadHandler, closeHandle goaio.OnCloseHandler) (goaio.ConnectionHandler, error) {
+		return goaio.GetTcpClient(dialHost(host), port, onData, func(err error) {
+			log.Printf("connection closed! remote-host=%s, remote-port=%s, errMsg=%s\n", host, strconv.Itoa(port), err)
+			closeHandle(err)
+			notifyLost()
+		})
+	}, c.options.ConnectionOptions)
+	if err != nil {
+		log.Printf("connect failed! host=%s, port=%s, errMsg=%s\n", host, strconv.Itoa(port), err)
+		return nil, nil, err
+	}
+
+	handler.OnGoAway(notifyLost)
+	return handler, lost, nil
+}
+
+func (c *ReconnectingClient) backoff(attempt int) time.Duration {
+	return exponentialBackoff(c.options.InitialBackoff, c.options.MaxBackoff, c.options.Jitter, attempt)
+}
+
+// initial * 2^attempt, at most max, randomized in [1 - jitter, 1 + jitter] of itself
+func exponentialBackoff(initial time.Duration, max time.Duration, jitter float64, attempt int) time.Duration {
+	backoff := max
+	if attempt < 32 && initial<<uint(attempt) < max {
+		backoff = initial << uint(attempt)
+	}
+	return time.Duration(float64(backoff) * (1 + jitter*(2*rand.Float64()-1)))
+}
+
+// returns false when client closed
+func (c *ReconnectingClient) sleep(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-c.closed:
+		return false
+	}
+}
+
+// get connected handler, wait for reconnecting when buffering calls, until timeout or ctx is done
+func (c *ReconnectingClient) getHandler(ctx context.Context, timeout time.Duration) (*PCPConnectionHandler, time.Duration, error) {
+	c.lock.Lock()
+	state, handler, connected := c.state, c.handler, c.connected
+	c.lock.Unlock()
+
+	if state == CONN_STATE_CLOSED {
+		return nil, timeout, ErrClientClosed
+	}
+	if handler != nil {
+		return handler, timeout, nil
+	}
+	if !c.options.BufferCalls {
+		return nil, timeout, ErrDisconnected
+	}
+
+	start := time.Now()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-connected:
+		return c.getHandler(ctx, timeout-time.Since(start))
+	case <-timer.C:
+		return nil, 0, ErrDisconnected
+	case <-ctx.Done():
+		return nil, 0, ctx.Err()
+	case <-c.closed:
+		return nil, 0, ErrClientClosed
+	}
+}
+
+func (c *ReconnectingClient) CallRemote(command string, timeout time.Duration) (interface{}, error) {
+	return c.CallRemoteContext(context.Background(), command, timeout)
+}
+
+func (c *ReconnectingClient) CallRemoteContext(ctx context.Context, command string, timeout time.Duration) (interface{}, error) {
+	if handler, timeout, err := c.getHandler(ctx, timeout); err != nil {
+		return nil, err
+	} else {
+		return handler.CallRemoteContext(ctx, command, timeout)
+	}
+}
+
+func (c *ReconnectingClient) Call(list gopcp.CallResult, timeout time.Duration) (interface{}, error) {
+	if handler, timeout, err := c.getHandler(context.Background(), timeout); err != nil {
+		return nil, err
+	} else {
+		return handler.Call(list, timeout)
+	}
+}
+
+func (c *ReconnectingClient) Close() {
+	c.closeOnce.Do(func() {
+		c.setState(CONN_STATE_CLOSED, nil)
+		close(c.closed)
+	})
+}
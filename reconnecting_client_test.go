@@ -0,0 +1,139 @@
+package gopcp_rpc
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestReconnectingClient(t *testing.T) {
+	server, err := GetPCPRPCServer(0, simpleSandbox, nil)
+	if err != nil {
+		t.Fatalf("fail to start server, %v", err)
+	}
+	port := server.GetPort()
+
+	var stateLock sync.Mutex
+	var states []ConnState
+
+	client := GetReconnectingClient(func() (string, int, error) {
+		return "127.0.0.1", port, nil
+	}, simpleSandbox, ReconnectOptions{
+		InitialBackoff: 10 * time.Millisecond,
+		MaxBackoff:     50 * time.Millisecond,
+		BufferCalls:    true,
+		OnStateChange: func(from ConnState, to ConnState) {
+			stateLock.Lock()
+			states = append(states, to)
+			stateLock.Unlock()
+		},
+	})
+	defer client.Close()
+
+	// buffered until connected
+	ret, err := client.CallRemote(`["add", 1, 2]`, time.Second)
+	assertEqual(t, err, nil, "")
+	assertEqual(t, ret, 3.0, "")
+
+	// restart server at the same port
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	server.Shutdown(ctx)
+
+	time.Sleep(50 * time.Millisecond)
+	server, err = GetPCPRPCServer(port, simpleSandbox, nil)
+	if err != nil {
+		t.Fatalf("fail to restart server, %v", err)
+	}
+	defer server.Close()
+
+	ret, err = client.CallRemote(`["add", 1, 2]`, 2*time.Second)
+	assertEqual(t, err, nil, "")
+	assertEqual(t, ret, 3.0, "")
+	assertEqual(t, client.State(), CONN_STATE_CONNECTED, "")
+
+	client.Close()
+	_, err = client.CallRemote(`["add", 1, 2]`, time.Second)
+	assertEqual(t, err, ErrClientClosed, "")
+
+	stateLock.Lock()
+	defer stateLock.Unlock()
+	assertEqual(t, states[0], CONN_STATE_CONNECTED, "")
+	assertEqual(t, states[1], CONN_STATE_DISCONNECTED, "")
+	assertEqual(t, states[len(states)-2], CONN_STATE_CONNECTED, "")
+	assertEqual(t, states[len(states)-1], CONN_STATE_CLOSED, "")
+}
+
+func TestReconnectingClientFailFast(t *testing.T) {
+	server, err := GetPCPRPCServer(0, simpleSandbox, nil)
+	if err != nil {
+		t.Fatalf("fail to start server, %v", err)
+	}
+	port := server.GetPort()
+	server.Close()
+
+	client := GetReconnectingClient(func() (string, int, error) {
+		return "127.0.0.1", port, nil
+	}, simpleSandbox, ReconnectOptions{InitialBackoff: 10 * time.Millisecond})
+	defer client.Close()
+
+	_, err = client.CallRemote(`["add", 1, 2]`, time.Second)
+	assertEqual(t, err, ErrDisconnected, "")
+}
+
+func TestReconnectingClientBackoffAfterLost(t *testing.T) {
+	// accepts connections and closes them at once
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("fail to listen, %v", err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	var dials int32
+	client := GetReconnectingClient(func() (string, int, error) {
+		atomic.AddInt32(&dials, 1)
+		return "127.0.0.1", listener.Addr().(*net.TCPAddr).Port, nil
+	}, simpleSandbox, ReconnectOptions{InitialBackoff: 20 * time.Millisecond, Jitter: 0.01})
+	defer client.Close()
+
+	// 20 + 40 + 80 + 160 ms
+	time.Sleep(300 * time.Millisecond)
+	if n := atomic.LoadInt32(&dials); n > 6 {
+		t.Errorf("expect backoff between dials, dialed %d times", n)
+	}
+}
+
+func TestReconnectingClientBufferedCallContext(t *testing.T) {
+	server, err := GetPCPRPCServer(0, simpleSandbox, nil)
+	if err != nil {
+		t.Fatalf("fail to start server, %v", err)
+	}
+	port := server.GetPort()
+	server.Close()
+
+	client := GetReconnectingClient(func() (string, int, error) {
+		return "127.0.0.1", port, nil
+	}, simpleSandbox, ReconnectOptions{InitialBackoff: 10 * time.Millisecond, BufferCalls: true})
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = client.CallRemoteContext(ctx, `["add", 1, 2]`, 10*time.Second)
+	assertEqual(t, err, context.DeadlineExceeded, "")
+	if time.Since(start) > time.Second {
+		t.Errorf("buffered call should stop waiting when ctx is done")
+	}
+}
@@ -0,0 +1,255 @@
+package gopcp_rpc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// service discovery
+// resolver produces a watchable list of endpoints, pool and balanced client follow endpoint changes.
+
+type Resolver interface {
+	// current endpoints
+	Resolve() ([]Endpoint, error)
+	// onChange is called with new endpoints when they are different from last ones, starting from resolved ones.
+	// returns function to stop watching
+	Watch(resolved []Endpoint, onChange func([]Endpoint)) func()
+}
+
+const DEFAULT_RESOLVE_INTERVAL = 10 * time.Second
+
+// static list of endpoints, never changes
+type StaticResolver struct {
+	endpoints []Endpoint
+}
+
+func GetStaticResolver(endpoints ...Endpoint) *StaticResolver {
+	return &StaticResolver{endpoints}
+}
+
+func (r *StaticResolver) Resolve() ([]Endpoint, error) {
+	return r.endpoints, nil
+}
+
+func (r *StaticResolver) Watch(resolved []Endpoint, onChange func([]Endpoint)) func() {
+	return func() {}
+}
+
+// resolve endpoints on every interval, onChange is called when resolved endpoints are different from last time
+type PollingResolver struct {
+	resolve  func() ([]Endpoint, error)
+	interval time.Duration
+}
+
+func GetPollingResolver(resolve func() ([]Endpoint, error), interval time.Duration) *PollingResolver {
+	if interval <= 0 {
+		interval = DEFAULT_RESOLVE_INTERVAL
+	}
+	return &PollingResolver{resolve, interval}
+}
+
+func (r *PollingResolver) Resolve() ([]Endpoint, error) {
+	endpoints, err := r.resolve()
+	if err != nil {
+		return nil, err
+	}
+	sortEndpoints(endpoints)
+	return endpoints, nil
+}
+
+func (r *PollingResolver) Watch(resolved []Endpoint, onChange func([]Endpoint)) func() {
+	stop := make(chan struct{})
+	var stopOnce sync.Once
+
+	// changes after resolved are reported, even before the first tick
+	last := append([]Endpoint{}, resolved...)
+	sortEndpoints(last)
+
+	go func() {
+		ticker := time.NewTicker(r.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				// keep last endpoints when fail to resolve
+				if endpoints, err := r.Resolve(); err != nil {
+					fmt.Printf("fail to resolve endpoints: %v\n", err)
+				} else if !equalEndpoints(last, endpoints) {
+					last = endpoints
+					onChange(endpoints)
+				}
+			}
+		}
+	}()
+
+	return func() {
+		stopOnce.Do(func() {
+			close(stop)
+		})
+	}
+}
+
+// A and AAAA records of host, every address is served at the same port
+func GetDNSResolver(host string, port int, interval time.Duration) *PollingResolver {
+	return GetPollingResolver(func() ([]Endpoint, error) {
+		addrs, err := net.DefaultResolver.LookupIPAddr(context.Background(), host)
+		if err != nil {
+			return nil, err
+		}
+		var endpoints []Endpoint
+		for _, addr := range addrs {
+			endpoints = append(endpoints, Endpoint{addr.IP.String(), port})
+		}
+		return endpoints, nil
+	}, interval)
+}
+
+// tcp client joins host and port with ":", ipv6 address should be in brackets
+func dialHost(host string) string {
+	if strings.Contains(host, ":") && !strings.HasPrefix(host, "[") {
+		return "[" + host + "]"
+	}
+	return host
+}
+
+// SRV records, eg: _pcp._tcp.example.com => GetDNSSRVResolver("pcp", "tcp", "example.com", interval)
+func GetDNSSRVResolver(service string, proto string, name string, interval time.Duration) *PollingResolver {
+	return GetPollingResolver(func() ([]Endpoint, error) {
+		_, srvs, err := net.LookupSRV(service, proto, name)
+		if err != nil {
+			return nil, err
+		}
+		var endpoints []Endpoint
+		for _, srv := range srvs {
+			endpoints = append(endpoints, Endpoint{strings.TrimSuffix(srv.Target, "."), int(srv.Port)})
+		}
+		return endpoints, nil
+	}, interval)
+}
+
+// watched file of endpoint list, yaml when extension is .yaml or .yml, otherwise json
+// eg: [{"host": "127.0.0.1", "port": 8081}]
+func GetFileResolver(path string, interval time.Duration) *PollingResolver {
+	return GetPollingResolver(func() ([]Endpoint, error) {
+		bytes, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		var endpoints []Endpoint
+		switch strings.ToLower(filepath.Ext(path)) {
+		case ".yaml", ".yml":
+			err = yaml.Unmarshal(bytes, &endpoints)
+		default:
+			err = json.Unmarshal(bytes, &endpoints)
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, endpoint := range endpoints {
+			if endpoint.Host == "" || endpoint.Port <= 0 {
+				return nil, errors.New("invalid endpoint in " + path + ": " + endpoint.String())
+			}
+		}
+		return endpoints, nil
+	}, interval)
+}
+
+func sortEndpoints(endpoints []Endpoint) {
+	sort.Slice(endpoints, func(i, j int) bool {
+		return endpoints[i].String() < endpoints[j].String()
+	})
+}
+
+// both are sorted
+func equalEndpoints(e1 []Endpoint, e2 []Endpoint) bool {
+	if len(e1) != len(e2) {
+		return false
+	}
+	for i := range e1 {
+		if e1[i] != e2[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// round robin over the latest resolved endpoints
+type resolverAddress struct {
+	lock      sync.Mutex
+	endpoints []Endpoint
+	next      int
+	preferred []Endpoint // dialed before round robin, to rebalance connections
+}
+
+// returns endpoints which were not resolved before
+func (r *resolverAddress) update(endpoints []Endpoint) []Endpoint {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	var added []Endpoint
+	for _, endpoint := range endpoints {
+		if !r.containsLocked(endpoint) {
+			added = append(added, endpoint)
+		}
+	}
+	r.endpoints = endpoints
+	return added
+}
+
+func (r *resolverAddress) contains(endpoint Endpoint) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.containsLocked(endpoint)
+}
+
+func (r *resolverAddress) containsLocked(endpoint Endpoint) bool {
+	for _, e := range r.endpoints {
+		if e == endpoint {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *resolverAddress) list() []Endpoint {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return append([]Endpoint{}, r.endpoints...)
+}
+
+// next dial goes to endpoint
+func (r *resolverAddress) prefer(endpoint Endpoint) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.preferred = append(r.preferred, endpoint)
+}
+
+func (r *resolverAddress) getAddress() (string, int, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for len(r.preferred) > 0 {
+		endpoint := r.preferred[0]
+		r.preferred = r.preferred[1:]
+		if r.containsLocked(endpoint) {
+			return endpoint.Host, endpoint.Port, nil
+		}
+	}
+	if len(r.endpoints) == 0 {
+		return "", 0, errors.New("no endpoint resolved.")
+	}
+	endpoint := r.endpoints[r.next%len(r.endpoints)]
+	r.next++
+	return endpoint.Host, endpoint.Port, nil
+}
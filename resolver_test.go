@@ -0,0 +1,194 @@
+package gopcp_rpc
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileResolver(t *testing.T) {
+	dir, err := ioutil.TempDir("", "resolver")
+	if err != nil {
+		t.Fatalf("fail to create temp dir, %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	jsonPath := filepath.Join(dir, "endpoints.json")
+	ioutil.WriteFile(jsonPath, []byte(`[{"host": "127.0.0.2", "port": 2}, {"host": "127.0.0.1", "port": 1}]`), 0644)
+	endpoints, err := GetFileResolver(jsonPath, time.Second).Resolve()
+	assertEqual(t, err, nil, "")
+	assertEqual(t, len(endpoints), 2, "")
+	assertEqual(t, endpoints[0], Endpoint{"127.0.0.1", 1}, "")
+
+	yamlPath := filepath.Join(dir, "endpoints.yaml")
+	ioutil.WriteFile(yamlPath, []byte("- host: 127.0.0.1\n  port: 1\n"), 0644)
+	resolver := GetFileResolver(yamlPath, 10*time.Millisecond)
+	endpoints, err = resolver.Resolve()
+	assertEqual(t, err, nil, "")
+	assertEqual(t, len(endpoints), 1, "")
+	assertEqual(t, endpoints[0], Endpoint{"127.0.0.1", 1}, "")
+
+	changes := make(chan []Endpoint, 1)
+	stop := resolver.Watch(endpoints, func(endpoints []Endpoint) {
+		changes <- endpoints
+	})
+	defer stop()
+
+	time.Sleep(30 * time.Millisecond)
+	ioutil.WriteFile(yamlPath, []byte("- host: 127.0.0.1\n  port: 1\n- host: 127.0.0.1\n  port: 3\n"), 0644)
+	select {
+	case endpoints := <-changes:
+		assertEqual(t, len(endpoints), 2, "")
+		assertEqual(t, endpoints[1], Endpoint{"127.0.0.1", 3}, "")
+	case <-time.After(time.Second):
+		t.Fatalf("expect endpoints change")
+	}
+}
+
+func TestResolverWatchFromResolved(t *testing.T) {
+	endpoints := []Endpoint{{"127.0.0.1", 1}}
+	resolver := GetPollingResolver(func() ([]Endpoint, error) {
+		return endpoints, nil
+	}, 10*time.Millisecond)
+	resolved, _ := resolver.Resolve()
+
+	// changed before watching, reported at the first poll
+	endpoints = []Endpoint{{"127.0.0.1", 2}}
+	changes := make(chan []Endpoint, 1)
+	stop := resolver.Watch(resolved, func(endpoints []Endpoint) {
+		changes <- endpoints
+	})
+	defer stop()
+
+	select {
+	case endpoints := <-changes:
+		assertEqual(t, len(endpoints), 1, "")
+		assertEqual(t, endpoints[0], Endpoint{"127.0.0.1", 2}, "")
+	case <-time.After(time.Second):
+		t.Fatalf("expect endpoints change")
+	}
+}
+
+func TestDialHost(t *testing.T) {
+	assertEqual(t, dialHost("127.0.0.1"), "127.0.0.1", "")
+	assertEqual(t, dialHost("localhost"), "localhost", "")
+	assertEqual(t, dialHost("::1"), "[::1]", "")
+	assertEqual(t, dialHost("[::1]"), "[::1]", "")
+}
+
+func TestDNSResolver(t *testing.T) {
+	endpoints, err := GetDNSResolver("localhost", 8081, time.Second).Resolve()
+	if err != nil {
+		t.Skipf("can not resolve localhost, %v", err)
+	}
+	found := false
+	for _, endpoint := range endpoints {
+		if endpoint == (Endpoint{"127.0.0.1", 8081}) {
+			found = true
+		}
+	}
+	assertEqual(t, found, true, "")
+}
+
+func TestPoolFollowsResolver(t *testing.T) {
+	servers, endpoints := testBalancedServers(t, "a", "b")
+	defer servers[0].Close()
+	defer servers[1].Close()
+
+	dir, err := ioutil.TempDir("", "resolver")
+	if err != nil {
+		t.Fatalf("fail to create temp dir, %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeEndpoints := func(endpoint Endpoint) {
+		bytes, _ := JSONMarshal([]Endpoint{endpoint})
+		ioutil.WriteFile(filepath.Join(dir, "endpoints.json"), bytes, 0644)
+	}
+	writeEndpoints(endpoints[0])
+	resolver := GetFileResolver(filepath.Join(dir, "endpoints.json"), 10*time.Millisecond)
+
+	pool, err := GetPCPRPCPoolFromResolver(resolver, simpleSandbox, 2, 10*time.Millisecond, 10*time.Millisecond, PoolOptions{})
+	assertEqual(t, err, nil, "")
+	defer pool.Shutdown()
+
+	balanced, err := GetBalancedClientFromResolver(resolver, simpleSandbox, BalancedClientOptions{})
+	assertEqual(t, err, nil, "")
+	defer balanced.Close()
+
+	callName := func() (interface{}, interface{}) {
+		client, err := pool.Get()
+		if err != nil {
+			return nil, nil
+		}
+		ret1, _ := client.CallRemote(`["name"]`, time.Second)
+		ret2, _ := balanced.CallRemote(`["name"]`, time.Second)
+		return ret1, ret2
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	ret1, ret2 := callName()
+	assertEqual(t, ret1, "a", "")
+	assertEqual(t, ret2, "a", "")
+
+	writeEndpoints(endpoints[1])
+	time.Sleep(100 * time.Millisecond)
+	for i := 0; i < 5; i++ {
+		ret1, ret2 := callName()
+		assertEqual(t, ret1, "b", "")
+		assertEqual(t, ret2, "b", "")
+	}
+}
+
+func TestPoolRebalancesAddedEndpoints(t *testing.T) {
+	servers, endpoints := testBalancedServers(t, "a", "b")
+	defer servers[0].Close()
+	defer servers[1].Close()
+
+	dir, err := ioutil.TempDir("", "resolver")
+	if err != nil {
+		t.Fatalf("fail to create temp dir, %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeEndpoints := func(endpoints ...Endpoint) {
+		bytes, _ := JSONMarshal(endpoints)
+		ioutil.WriteFile(filepath.Join(dir, "endpoints.json"), bytes, 0644)
+	}
+	writeEndpoints(endpoints[0])
+	resolver := GetFileResolver(filepath.Join(dir, "endpoints.json"), 10*time.Millisecond)
+
+	pool, err := GetPCPRPCPoolFromResolver(resolver, simpleSandbox, 4, 10*time.Millisecond, 10*time.Millisecond, PoolOptions{})
+	assertEqual(t, err, nil, "")
+	defer pool.Shutdown()
+
+	// healthy connections per endpoint
+	counts := func() map[Endpoint]int {
+		counts := map[Endpoint]int{}
+		pool.connections.Range(func(_, value interface{}) bool {
+			if connection := value.(*poolConnection); connection.isHealthy() {
+				counts[connection.endpoint]++
+			}
+			return true
+		})
+		return counts
+	}
+	waitCounts := func(a, b int) {
+		for i := 0; ; i++ {
+			c := counts()
+			if c[endpoints[0]] == a && c[endpoints[1]] == b {
+				return
+			}
+			if i > 100 {
+				t.Fatalf("expect %d, %d connections, got %v", a, b, c)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	waitCounts(4, 0)
+	writeEndpoints(endpoints[0], endpoints[1])
+	waitCounts(2, 2)
+}
@@ -0,0 +1,253 @@
+package gopcp_rpc
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"github.com/lock-free/gopcp"
+	"github.com/lock-free/gopcp_stream"
+	"github.com/satori/go.uuid"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// resumable stream
+// every item of a resumable stream has a sequence number, and is kept in a StreamBuffer at producer side.
+// chunk data is {"key": stream key, "seq": sequence number, "data": item}.
+// resume token is "key:seq" of the last item consumer received. Calling the stream function again with it,
+// producer replays buffered items after seq, then handler continues producing after the last buffered item.
+// eg:
+//   stream, err := client.ResumableStream(ctx, time.Minute, "tail", token, "app.log")
+//   for item := range stream.C {
+//     token = item.(SeqItem).Token
+//   }
+
+const DEFAULT_STREAM_BUFFER_CAPACITY = 1024
+const DEFAULT_STREAM_BUFFER_TTL = 10 * time.Minute
+
+var ErrStreamResumeExpired = errors.New("stream can not be resumed, items after resume token are dropped.")
+var ErrBadResumeToken = errors.New("bad resume token of stream.")
+
+type SeqItem struct {
+	Seq  uint64
+	Data interface{}
+	// resume token after this item, filled at consumer side
+	Token string
+}
+
+// holds recent items of resumable streams at producer side
+type StreamBuffer interface {
+	Append(key string, item SeqItem) error
+	// items with Seq greater than seq in order, false when some of them were dropped or key is unknown
+	After(key string, seq uint64) ([]SeqItem, bool, error)
+	// last appended item
+	Last(key string) (SeqItem, bool, error)
+}
+
+// keeps last capacity items per stream in memory, streams without new items in ttl are dropped
+type MemoryStreamBuffer struct {
+	capacity int
+	ttl      time.Duration
+
+	lock    sync.Mutex
+	streams map[string]*bufferedStream
+}
+
+type bufferedStream struct {
+	items     *list.List
+	updatedAt time.Time
+}
+
+func GetMemoryStreamBuffer(capacity int, ttl time.Duration) *MemoryStreamBuffer {
+	if capacity <= 0 {
+		capacity = DEFAULT_STREAM_BUFFER_CAPACITY
+	}
+	if ttl <= 0 {
+		ttl = DEFAULT_STREAM_BUFFER_TTL
+	}
+	return &MemoryStreamBuffer{capacity: capacity, ttl: ttl, streams: map[string]*bufferedStream{}}
+}
+
+func (b *MemoryStreamBuffer) Append(key string, item SeqItem) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	now := time.Now()
+	for k, stream := range b.streams {
+		if now.Sub(stream.updatedAt) > b.ttl {
+			delete(b.streams, k)
+		}
+	}
+
+	stream, ok := b.streams[key]
+	if !ok {
+		stream = &bufferedStream{items: list.New()}
+		b.streams[key] = stream
+	}
+	stream.items.PushBack(item)
+	stream.updatedAt = now
+	if stream.items.Len() > b.capacity {
+		stream.items.Remove(stream.items.Front())
+	}
+	return nil
+}
+
+func (b *MemoryStreamBuffer) After(key string, seq uint64) ([]SeqItem, bool, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	stream, ok := b.streams[key]
+	if !ok {
+		return nil, seq == 0, nil
+	}
+
+	var items []SeqItem
+	for e := stream.items.Front(); e != nil; e = e.Next() {
+		if item := e.Value.(SeqItem); item.Seq > seq {
+			items = append(items, item)
+		}
+	}
+	// the first item after seq is dropped
+	if first := stream.items.Front(); first != nil && first.Value.(SeqItem).Seq > seq+1 {
+		return items, false, nil
+	}
+	return items, true, nil
+}
+
+func (b *MemoryStreamBuffer) Last(key string) (SeqItem, bool, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if stream, ok := b.streams[key]; ok && stream.items.Len() > 0 {
+		return stream.items.Back().Value.(SeqItem), true, nil
+	}
+	return SeqItem{}, false, nil
+}
+
+func ResumeToken(key string, seq uint64) string {
+	return key + ":" + strconv.FormatUint(seq, 10)
+}
+
+func parseResumeToken(token string) (string, uint64, error) {
+	i := strings.LastIndex(token, ":")
+	if i <= 0 {
+		return "", 0, ErrBadResumeToken
+	}
+	seq, err := strconv.ParseUint(token[i+1:], 10, 64)
+	if err != nil {
+		return "", 0, ErrBadResumeToken
+	}
+	return token[:i], seq, nil
+}
+
+// producer of a resumable stream, items are appended to buffer before sent
+type ResumableProducer struct {
+	producer gopcp_stream.StreamProducer
+	buffer   StreamBuffer
+	key      string
+	seq      uint64
+	last     *SeqItem
+}
+
+func (r *ResumableProducer) Key() string {
+	return r.key
+}
+
+// last item produced before resuming, handler continues after it
+func (r *ResumableProducer) Last() (SeqItem, bool) {
+	if r.last == nil {
+		return SeqItem{}, false
+	}
+	return *r.last, true
+}
+
+func (r *ResumableProducer) SendData(d interface{}, timeout time.Duration) (interface{}, error) {
+	item := SeqItem{Seq: r.seq + 1, Data: d}
+	if err := r.buffer.Append(r.key, item); err != nil {
+		return nil, err
+	}
+	r.seq = item.Seq
+	return r.send(item, timeout)
+}
+
+func (r *ResumableProducer) SendEnd(timeout time.Duration) (interface{}, error) {
+	return r.producer.SendEnd(timeout)
+}
+
+func (r *ResumableProducer) SendError(errMsg string, timeout time.Duration) (interface{}, error) {
+	return r.producer.SendError(errMsg, timeout)
+}
+
+func (r *ResumableProducer) send(item SeqItem, timeout time.Duration) (interface{}, error) {
+	return r.producer.SendData(map[string]interface{}{
+		"key":  r.key,
+		"seq":  item.Seq,
+		"data": item.Data,
+	}, timeout)
+}
+
+// define resumable stream function, called with (...params, resumeToken, streamId), resumeToken is "" for a new stream.
+// a stream key should be produced by one handler at a time.
+func ResumableStreamApi(streamServer *gopcp_stream.StreamServer, buffer StreamBuffer, handle func(*ResumableProducer, []interface{}, interface{}, *gopcp.PcpServer) (interface{}, error)) *gopcp.BoxFunc {
+	return streamServer.StreamApi(func(streamProducer gopcp_stream.StreamProducer, args []interface{}, attachment interface{}, pcpServer *gopcp.PcpServer) (interface{}, error) {
+		if len(args) < 1 {
+			return nil, errors.New("missing resume token at the resumable stream request")
+		}
+		token, ok := args[len(args)-1].(string)
+		if !ok {
+			return nil, errors.New("missing resume token (string) at the resumable stream request")
+		}
+
+		producer := &ResumableProducer{producer: streamProducer, buffer: buffer, key: uuid.NewV4().String()}
+		if token != "" {
+			key, seq, err := parseResumeToken(token)
+			if err != nil {
+				return nil, err
+			}
+			items, ok, err := buffer.After(key, seq)
+			if err != nil {
+				return nil, err
+			} else if !ok {
+				return nil, ErrStreamResumeExpired
+			}
+
+			last, ok, err := buffer.Last(key)
+			if err != nil {
+				return nil, err
+			}
+
+			producer.key = key
+			producer.seq = seq
+			if ok {
+				producer.seq = last.Seq
+				producer.last = &last
+			}
+			for _, item := range items {
+				if _, err := producer.send(item, DEFAULT_STREAM_CLOSE_TIMEOUT); err != nil {
+					return nil, err
+				}
+			}
+		}
+
+		return handle(producer, args[:len(args)-1], attachment, pcpServer)
+	})
+}
+
+// call resumable stream function, items on C are SeqItem. token is "" for a new stream,
+// or Token of the last item received, then stream continues after it.
+func (p *PCPConnectionHandler) ResumableStream(ctx context.Context, timeout time.Duration, streamFunName string, token string, params ...interface{}) (*Stream, error) {
+	stream, _, err := p.startStream(ctx, timeout, streamFunName, append(params, token), decodeSeqItem)
+	return stream, err
+}
+
+func decodeSeqItem(d interface{}) interface{} {
+	m, ok := d.(map[string]interface{})
+	if !ok {
+		return d
+	}
+	key, _ := m["key"].(string)
+	seq, _ := m["seq"].(float64)
+	return SeqItem{Seq: uint64(seq), Data: m["data"], Token: ResumeToken(key, uint64(seq))}
+}
@@ -0,0 +1,110 @@
+package gopcp_rpc
+
+import (
+	"context"
+	"github.com/lock-free/gopcp"
+	"github.com/lock-free/gopcp_stream"
+	"testing"
+	"time"
+)
+
+func TestMemoryStreamBuffer(t *testing.T) {
+	buffer := GetMemoryStreamBuffer(3, time.Minute)
+	for i := 1; i <= 5; i++ {
+		buffer.Append("k", SeqItem{Seq: uint64(i), Data: i})
+	}
+
+	items, ok, _ := buffer.After("k", 2)
+	assertEqual(t, ok, true, "")
+	assertEqual(t, len(items), 3, "")
+	assertEqual(t, items[0].Seq, uint64(3), "")
+
+	_, ok, _ = buffer.After("k", 1)
+	assertEqual(t, ok, false, "")
+	_, ok, _ = buffer.After("unknown", 1)
+	assertEqual(t, ok, false, "")
+
+	last, ok, _ := buffer.Last("k")
+	assertEqual(t, ok, true, "")
+	assertEqual(t, last.Data, 5, "")
+}
+
+// count sends 1..10, continues after the last produced item when resumed
+func resumableSandbox(buffer StreamBuffer, stopped chan error) GenerateSandbox {
+	return func(streamServer *gopcp_stream.StreamServer) *gopcp.Sandbox {
+		return gopcp.GetSandbox(map[string]*gopcp.BoxFunc{
+			"count": ResumableStreamApi(streamServer, buffer, func(producer *ResumableProducer, args []interface{}, attachment interface{}, pcpServer *gopcp.PcpServer) (interface{}, error) {
+				i := 1
+				if last, ok := producer.Last(); ok {
+					i = last.Data.(int) + 1
+				}
+				for ; i <= 10; i++ {
+					if _, err := producer.SendData(i, 10*time.Second); err != nil {
+						stopped <- err
+						return nil, err
+					}
+					time.Sleep(5 * time.Millisecond)
+				}
+				producer.SendEnd(10 * time.Second)
+				return nil, nil
+			}),
+		})
+	}
+}
+
+func TestResumableStream(t *testing.T) {
+	stopped := make(chan error, 1)
+	server, err := GetPCPRPCServer(0, resumableSandbox(GetMemoryStreamBuffer(0, 0), stopped), nil)
+	if err != nil {
+		t.Fatalf("fail to start server, %v", err)
+	}
+	defer server.Close()
+
+	client, err := GetPCPRPCClient("127.0.0.1", server.GetPort(), simpleSandbox, nil)
+	assertEqual(t, err, nil, "")
+	stream, err := client.ResumableStream(context.Background(), time.Minute, "count", "")
+	assertEqual(t, err, nil, "")
+
+	token := ""
+	for i := 1; i <= 3; i++ {
+		item := (<-stream.C).(SeqItem)
+		assertEqual(t, item.Seq, uint64(i), "")
+		assertEqual(t, item.Data, float64(i), "")
+		token = item.Token
+	}
+	// connection lost in the middle of stream
+	client.Close()
+	<-stopped
+
+	client, err = GetPCPRPCClient("127.0.0.1", server.GetPort(), simpleSandbox, nil)
+	assertEqual(t, err, nil, "")
+	defer client.Close()
+	stream, err = client.ResumableStream(context.Background(), time.Minute, "count", token)
+	assertEqual(t, err, nil, "")
+
+	next := 4
+	for item := range stream.C {
+		assertEqual(t, item.(SeqItem).Seq, uint64(next), "")
+		assertEqual(t, item.(SeqItem).Data, float64(next), "")
+		next++
+	}
+	assertEqual(t, stream.Err(), nil, "")
+	assertEqual(t, next, 11, "")
+}
+
+func TestResumableStreamExpired(t *testing.T) {
+	server, err := GetPCPRPCServer(0, resumableSandbox(GetMemoryStreamBuffer(0, 0), make(chan error, 1)), nil)
+	if err != nil {
+		t.Fatalf("fail to start server, %v", err)
+	}
+	defer server.Close()
+	client, err := GetPCPRPCClient("127.0.0.1", server.GetPort(), simpleSandbox, nil)
+	assertEqual(t, err, nil, "")
+	defer client.Close()
+
+	stream, err := client.ResumableStream(context.Background(), time.Minute, "count", ResumeToken("unknown", 3))
+	assertEqual(t, err, nil, "")
+	for range stream.C {
+	}
+	assertEqual(t, stream.Err().(*CallError).ErrMsg, ErrStreamResumeExpired.Error(), "")
+}
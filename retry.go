@@ -0,0 +1,139 @@
+package gopcp_rpc
+
+import (
+	"encoding/json"
+	"sync/atomic"
+	"time"
+)
+
+// retry policy applied by pool and balanced client
+// a failed call is retried when:
+// (1) request was never sent (connection broken, remote going away, circuit open, no healthy backend, disconnected), for any function
+// (2) function is idempotent, and call failed at transport level (connection closed, timeout) or remote answered a retryable errno
+
+const DEFAULT_RETRY_INITIAL_BACKOFF = 50 * time.Millisecond
+const DEFAULT_RETRY_MAX_BACKOFF = 2 * time.Second
+const DEFAULT_RETRY_JITTER = 0.2
+
+type RetryPolicy struct {
+	// attempts including the first one, no retry when it is less than 2
+	MaxAttempts int
+	// backoff before n-th retry is InitialBackoff * 2^n, at most MaxBackoff
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	// backoff is randomized in [1 - Jitter, 1 + Jitter] of itself
+	Jitter float64
+	// errnos answered by remote which are worth retrying, only for idempotent functions
+	RetryableErrnos []int
+	// calls of idempotent function are safe to execute more than once
+	Idempotent bool
+	// policy by function name, replaces this policy for calls of the function
+	Functions map[string]RetryPolicy
+}
+
+type RetryStats struct {
+	Calls     int64 // calls made by callers
+	Attempts  int64 // attempts sent, including retries
+	Retries   int64
+	Exhausted int64 // calls still failed after max attempts
+}
+
+type retrier struct {
+	policy    *RetryPolicy
+	calls     int64
+	attempts  int64
+	retries   int64
+	exhausted int64
+}
+
+func newRetrier(policy *RetryPolicy) *retrier {
+	return &retrier{policy: policy}
+}
+
+func (r *retrier) Stats() RetryStats {
+	return RetryStats{
+		Calls:     atomic.LoadInt64(&r.calls),
+		Attempts:  atomic.LoadInt64(&r.attempts),
+		Retries:   atomic.LoadInt64(&r.retries),
+		Exhausted: atomic.LoadInt64(&r.exhausted),
+	}
+}
+
+func (r *retrier) policyOf(command string) RetryPolicy {
+	if r.policy == nil {
+		return RetryPolicy{}
+	}
+	policy := *r.policy
+	if override, ok := policy.Functions[commandFunctionName(command)]; ok {
+		policy = override
+	}
+	if policy.InitialBackoff <= 0 {
+		policy.InitialBackoff = DEFAULT_RETRY_INITIAL_BACKOFF
+	}
+	if policy.MaxBackoff <= 0 {
+		policy.MaxBackoff = DEFAULT_RETRY_MAX_BACKOFF
+	}
+	if policy.Jitter < 0 || policy.Jitter > 1 {
+		policy.Jitter = DEFAULT_RETRY_JITTER
+	}
+	return policy
+}
+
+// name of top level function of command, eg: ["add", 1, 2] => add
+func commandFunctionName(command string) string {
+	var list []interface{}
+	if err := json.Unmarshal([]byte(command), &list); err != nil || len(list) == 0 {
+		return ""
+	}
+	name, _ := list[0].(string)
+	return name
+}
+
+func (policy RetryPolicy) shouldRetry(err error) bool {
+	switch err {
+	case ErrGoingAway, ErrCircuitOpen, ErrNoHealthyBackend, ErrNoHealthyConnection, ErrDisconnected:
+		return true
+	}
+	if isSendError(err) {
+		return true
+	}
+
+	if !policy.Idempotent {
+		return false
+	}
+
+	if err == ErrConnectionClosed || isTimeoutError(err) {
+		return true
+	}
+	if callErr, ok := err.(*CallError); ok {
+		for _, errno := range policy.RetryableErrnos {
+			if errno == callErr.Errno {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// every attempt may go to a different connection or backend
+func (r *retrier) call(command string, attempt func() (interface{}, error)) (interface{}, error) {
+	policy := r.policyOf(command)
+	atomic.AddInt64(&r.calls, 1)
+
+	for i := 0; ; i++ {
+		atomic.AddInt64(&r.attempts, 1)
+		ret, err := attempt()
+		if err == nil || !policy.shouldRetry(err) {
+			return ret, err
+		}
+		if i+1 >= policy.MaxAttempts {
+			if policy.MaxAttempts > 1 {
+				atomic.AddInt64(&r.exhausted, 1)
+			}
+			return nil, err
+		}
+
+		atomic.AddInt64(&r.retries, 1)
+		time.Sleep(exponentialBackoff(policy.InitialBackoff, policy.MaxBackoff, policy.Jitter, i))
+	}
+}
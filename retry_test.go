@@ -0,0 +1,91 @@
+package gopcp_rpc
+
+import (
+	"errors"
+	"github.com/lock-free/gopcp"
+	"github.com/lock-free/gopcp_stream"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRetryPolicyShouldRetry(t *testing.T) {
+	policy := RetryPolicy{}
+	assertEqual(t, policy.shouldRetry(ErrGoingAway), true, "")
+	assertEqual(t, policy.shouldRetry(ErrConnectionClosed), false, "")
+
+	policy = RetryPolicy{Idempotent: true, RetryableErrnos: []int{ERRNO_EXECUTE_ERROR}}
+	assertEqual(t, policy.shouldRetry(ErrConnectionClosed), true, "")
+	assertEqual(t, policy.shouldRetry(&TimeoutError{"[]", time.Second}), true, "")
+	assertEqual(t, policy.shouldRetry(&CallError{ERRNO_EXECUTE_ERROR, "fail"}), true, "")
+	assertEqual(t, policy.shouldRetry(&CallError{ERRNO_BAD_REQUEST, "fail"}), false, "")
+	assertEqual(t, policy.shouldRetry(errors.New("fail")), false, "")
+
+	assertEqual(t, commandFunctionName(`["add", 1, 2]`), "add", "")
+	assertEqual(t, commandFunctionName(`1`), "", "")
+}
+
+// flaky fails the first 2 calls, unsafe always fails
+func flakySandbox(streamServer *gopcp_stream.StreamServer) *gopcp.Sandbox {
+	var count int32
+	return gopcp.GetSandbox(map[string]*gopcp.BoxFunc{
+		"flaky": gopcp.ToSandboxFun(func(args []interface{}, attachment interface{}, pcpServer *gopcp.PcpServer) (interface{}, error) {
+			if atomic.AddInt32(&count, 1) <= 2 {
+				return nil, errors.New("try again")
+			}
+			return "ok", nil
+		}),
+		"unsafe": gopcp.ToSandboxFun(func(args []interface{}, attachment interface{}, pcpServer *gopcp.PcpServer) (interface{}, error) {
+			return nil, errors.New("fail")
+		}),
+	})
+}
+
+func TestPoolRetry(t *testing.T) {
+	server, err := GetPCPRPCServer(0, flakySandbox, nil)
+	if err != nil {
+		t.Fatalf("fail to start server, %v", err)
+	}
+	defer server.Close()
+
+	pool := GetPCPRPCPoolWithOptions(func() (string, int, error) {
+		return "127.0.0.1", server.GetPort(), nil
+	}, simpleSandbox, 2, 10*time.Millisecond, 10*time.Millisecond, PoolOptions{
+		Retry: &RetryPolicy{
+			MaxAttempts:    3,
+			InitialBackoff: time.Millisecond,
+			Functions: map[string]RetryPolicy{
+				"flaky": {MaxAttempts: 3, InitialBackoff: time.Millisecond, Idempotent: true, RetryableErrnos: []int{ERRNO_EXECUTE_ERROR}},
+			},
+		},
+	})
+	defer pool.Shutdown()
+
+	p := gopcp.PcpClient{}
+	ret, err := pool.Call(p.Call("flaky"), time.Second)
+	assertEqual(t, err, nil, "")
+	assertEqual(t, ret, "ok", "")
+	assertEqual(t, pool.RetryStats(), RetryStats{Calls: 1, Attempts: 3, Retries: 2}, "")
+
+	// not idempotent, never retried
+	_, err = pool.Call(p.Call("unsafe"), time.Second)
+	assertEqual(t, err.(*CallError).Errno, ERRNO_EXECUTE_ERROR, "")
+	assertEqual(t, pool.RetryStats(), RetryStats{Calls: 2, Attempts: 4, Retries: 2}, "")
+}
+
+func TestBalancedClientRetry(t *testing.T) {
+	servers, endpoints := testBalancedServers(t, "a")
+	defer servers[0].Close()
+
+	client := GetBalancedClient(endpoints, simpleSandbox, BalancedClientOptions{
+		Retry: &RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond},
+	})
+	defer client.Close()
+	waitHealthy(t, client, 1)
+
+	// request is never sent while circuit is open or no backend is healthy, retried for any function
+	client.UpdateEndpoints(nil)
+	_, err := client.CallRemote(`["name"]`, time.Second)
+	assertEqual(t, err, ErrNoHealthyBackend, "")
+	assertEqual(t, client.RetryStats(), RetryStats{Calls: 1, Attempts: 3, Retries: 2, Exhausted: 1}, "")
+}
@@ -0,0 +1,249 @@
+package gopcp_rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/lock-free/gopcp"
+	"github.com/lock-free/gopcp_stream"
+	"github.com/satori/go.uuid"
+	"sync"
+	"time"
+)
+
+// channel based stream consumption
+// eg:
+//   stream, err := client.Stream(ctx, time.Minute, "streamApi", "seed")
+//   for item := range stream.C {}
+//   err = stream.Err()
+
+const DEFAULT_STREAM_BUFFER = 16
+
+type Stream struct {
+	// data items, closed when stream ended, failed or canceled
+	C <-chan interface{}
+
+	ch   chan interface{}
+	lock sync.Mutex // guards sending to ch and closing it
+	once sync.Once
+	done chan struct{}
+	err  error
+
+	cancel func() // tells producer that stream is canceled
+	decode func(interface{}) interface{}
+}
+
+func newStream() *Stream {
+	ch := make(chan interface{}, DEFAULT_STREAM_BUFFER)
+	return &Stream{C: ch, ch: ch, done: make(chan struct{})}
+}
+
+// nil when stream ended normally, valid after C is closed
+func (s *Stream) Err() error {
+	select {
+	case <-s.done:
+		return s.err
+	default:
+		return nil
+	}
+}
+
+// closed when stream finished
+func (s *Stream) Done() <-chan struct{} {
+	return s.done
+}
+
+func (s *Stream) finish(err error) {
+	s.once.Do(func() {
+		s.err = err
+		// wake up blocked sender before taking the lock
+		close(s.done)
+
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		close(s.ch)
+	})
+}
+
+// blocks when consumer is slow, until stream finished
+func (s *Stream) send(d interface{}) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	select {
+	case <-s.done:
+		return
+	default:
+	}
+
+	select {
+	case s.ch <- d:
+	case <-s.done:
+	}
+}
+
+func (s *Stream) accept(t int, d interface{}) {
+	switch t {
+	case gopcp_stream.STREAM_DATA:
+		if s.decode != nil {
+			d = s.decode(d)
+		}
+		s.send(d)
+	case gopcp_stream.STREAM_END:
+		s.finish(nil)
+	case gopcp_stream.STREAM_ERROR:
+		s.finish(errors.New(fmt.Sprint(d)))
+	}
+}
+
+// call stream function, items are received from stream.C.
+// Stream finishes with ctx.Err() when ctx is done, and with error when stream call failed or timeout.
+func (p *PCPConnectionHandler) Stream(ctx context.Context, timeout time.Duration, streamFunName string, params ...interface{}) (*Stream, error) {
+	stream, _, err := p.startStream(ctx, timeout, streamFunName, params, nil)
+	return stream, err
+}
+
+// stream id is appended to params, as convention of stream api. decode converts data chunks when it is not nil.
+func (p *PCPConnectionHandler) startStream(ctx context.Context, timeout time.Duration, streamFunName string, params []interface{}, decode func(interface{}) interface{}) (*Stream, string, error) {
+	stream := newStream()
+	stream.decode = decode
+
+	id := p.registerStream(stream.accept, stream.finish)
+	stream.cancel = func() {
+		if err := p.CancelStream(id, DEFAULT_STREAM_CLOSE_TIMEOUT); err != nil {
+			fmt.Printf("fail to cancel stream %s: %v\n", id, err)
+		}
+	}
+	cmdText, err := p.PcpClient.ToJSON(p.PcpClient.Call(streamFunName, append(params, id)...))
+	if err != nil {
+		return nil, "", err
+	}
+
+	// stream call failed, callback is removed without telling producer
+	fail := func(err error) {
+		stream.finish(err)
+		p.acceptStream(id, gopcp_stream.STREAM_ERROR, err.Error())
+		p.streamQueues.Delete(id)
+	}
+
+	// request is sent before returning, so it arrives before chunks sent on the stream
+	callCtx, cancel := context.WithCancel(ctx)
+	if wait, err := p.sendCall(callCtx, cmdText, timeout); err != nil {
+		cancel()
+		fail(err)
+	} else {
+		go func() {
+			defer cancel()
+			// canceled call is finished by the watcher below
+			if _, err := wait(); err != nil && callCtx.Err() == nil {
+				fail(err)
+			}
+		}()
+	}
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			// same as Cancel, producer is told and callback is removed
+			stream.cancelWith(ctx.Err())
+		case <-stream.done:
+			cancel()
+		}
+	}()
+
+	return stream, id, nil
+}
+
+// stream consumed at this side. Callbacks are kept by the connection instead of stream client,
+// so finishing them never races with cleaning stream client.
+type consumedStream struct {
+	callback  gopcp_stream.StreamCallbackFunc
+	terminate func(error)
+}
+
+// register callback of a stream consumed at this side, terminate is called when connection is closed before stream ended
+func (p *PCPConnectionHandler) registerStream(callback gopcp_stream.StreamCallbackFunc, terminate func(error)) string {
+	sid := uuid.NewV4().String()
+	p.consumedStreams.Store(sid, &consumedStream{callback, terminate})
+
+	// connection was closed before registered
+	if p.isClosed() {
+		p.terminateStreams(ErrConnectionClosed)
+	}
+	return sid
+}
+
+// pass chunk to the callback of stream, callback is removed after end or error.
+// callbacks registered at stream client directly are called under streamClientLock, which is taken by Clean.
+func (p *PCPConnectionHandler) acceptStream(sid string, t int, d interface{}) error {
+	if t != gopcp_stream.STREAM_DATA && t != gopcp_stream.STREAM_END && t != gopcp_stream.STREAM_ERROR {
+		return errors.New("unexpected stream chunk type.")
+	}
+
+	var stream interface{}
+	var ok bool
+	if t == gopcp_stream.STREAM_DATA {
+		stream, ok = p.consumedStreams.Load(sid)
+	} else {
+		stream, ok = p.consumedStreams.LoadAndDelete(sid)
+	}
+	if !ok {
+		// registered at stream client directly
+		p.streamClientLock.RLock()
+		defer p.streamClientLock.RUnlock()
+		return p.StreamClient.Accept(sid, t, d)
+	}
+	stream.(*consumedStream).callback(t, d)
+	return nil
+}
+
+func (p *PCPConnectionHandler) terminateStreams(err error) {
+	p.consumedStreams.Range(func(sid, _ interface{}) bool {
+		if stream, ok := p.consumedStreams.LoadAndDelete(sid); ok {
+			stream.(*consumedStream).terminate(err)
+		}
+		return true
+	})
+}
+
+func streamChunkFormatError(args []interface{}) error {
+	return fmt.Errorf("stream chunk format: [streamId: string, t: int, d: interface{}]. args=%v", args)
+}
+
+// args = [streamId: string, t: int, d: interface{}]
+// streams of the connection are looked up first, then callbacks registered at stream client directly
+func getStreamAcceptBoxFun(streamClient *gopcp_stream.StreamClient) *gopcp.BoxFunc {
+	return gopcp.ToSandboxFun(func(args []interface{}, attachment interface{}, pcpServer *gopcp.PcpServer) (interface{}, error) {
+		if len(args) < 3 {
+			return nil, streamChunkFormatError(args)
+		} else if sid, ok := args[0].(string); !ok {
+			return nil, streamChunkFormatError(args)
+		} else if t, ok := args[1].(float64); !ok {
+			return nil, streamChunkFormatError(args)
+		} else if p, ok := getConnectionHandler(attachment); ok {
+			return nil, p.acceptStream(sid, int(t), args[2])
+		} else {
+			return nil, streamClient.Accept(sid, int(t), args[2])
+		}
+	})
+}
+
+// register stream callback, callback receives STREAM_ERROR when connection is closed before stream ended
+func (p *PCPConnectionHandler) StreamCallback(callback gopcp_stream.StreamCallbackFunc) string {
+	return p.registerStream(callback, func(err error) {
+		callback(gopcp_stream.STREAM_ERROR, err.Error())
+	})
+}
+
+// same as StreamClient.StreamCall, the last param is the stream callback, which is registered by StreamCallback
+func (p *PCPConnectionHandler) StreamCall(streamFunName string, params ...interface{}) (*gopcp.CallResult, error) {
+	if len(params) < 1 {
+		return nil, errors.New("missing stream callback function for stream call.")
+	}
+	callback, ok := params[len(params)-1].(gopcp_stream.StreamCallbackFunc)
+	if !ok {
+		return nil, errors.New("missing stream callback function for stream call.")
+	}
+	callExp := p.PcpClient.Call(streamFunName, append(params[:len(params)-1], p.StreamCallback(callback))...)
+	return &callExp, nil
+}
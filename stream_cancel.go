@@ -0,0 +1,87 @@
+package gopcp_rpc
+
+import (
+	"context"
+	"errors"
+	"github.com/lock-free/gopcp"
+	"github.com/lock-free/gopcp_stream"
+	"time"
+)
+
+// consumer initiated stream cancellation
+// consumer drops the stream callback and calls "__stream_cancel" at producer side,
+// producer marks the stream canceled, the next chunk of it fails with ErrStreamCanceled without being sent.
+// Stream.Cancel also cancels the request of stream function, so producer gets it from GetContext(attachment).
+
+var ErrStreamCanceled = errors.New("stream is canceled by consumer.")
+
+// cancel a stream consumed at this side, callback of the stream receives a STREAM_ERROR chunk
+func (p *PCPConnectionHandler) CancelStream(sid string, timeout time.Duration) error {
+	cmdText, err := p.PcpClient.ToJSON(p.PcpClient.Call(STREAM_CANCEL_NAME, sid))
+	if err == nil {
+		// producer stops sending chunks after it is acked
+		_, err = p.callRemote(context.Background(), cmdText, timeout)
+	}
+
+	// removes the callback, and stops tracking it
+	p.acceptStream(sid, gopcp_stream.STREAM_ERROR, ErrStreamCanceled.Error())
+	p.streamQueues.Delete(sid)
+	return err
+}
+
+// stop consuming the stream, C is closed and Err() returns ErrStreamCanceled
+func (s *Stream) Cancel() {
+	s.cancelWith(ErrStreamCanceled)
+}
+
+// finish with err, then producer is told and callback of stream is removed
+func (s *Stream) cancelWith(err error) {
+	select {
+	case <-s.done:
+		return
+	default:
+	}
+
+	s.finish(err)
+	if s.cancel != nil {
+		go s.cancel()
+	}
+}
+
+// canceled mark is removed by the first chunk it rejects, producer is told and should stop.
+// It is also removed when the stream request finished.
+func (p *PCPConnectionHandler) isStreamCanceled(sid string) bool {
+	if _, ok := p.canceledStreams.LoadAndDelete(sid); !ok {
+		return false
+	}
+	p.streamCredits.Delete(sid)
+	p.producedStreams.Delete(sid)
+	return true
+}
+
+// args = [streamId: string]
+func getStreamCancelBoxFun() *gopcp.BoxFunc {
+	return gopcp.ToSandboxFun(func(args []interface{}, attachment interface{}, pcpServer *gopcp.PcpServer) (interface{}, error) {
+		if len(args) < 1 {
+			return nil, errors.New("stream cancel format: [streamId: string].")
+		}
+		sid, ok := args[0].(string)
+		if !ok {
+			return nil, errors.New("stream cancel format: [streamId: string].")
+		}
+		p, ok := getConnectionHandler(attachment)
+		if !ok {
+			return nil, errors.New("stream cancel is only supported over pcp connection.")
+		}
+
+		// only streams still produced are marked, otherwise nobody removes the mark
+		p.streamLock.Lock()
+		defer p.streamLock.Unlock()
+		_, pending := p.streamRequests.Load(sid)
+		_, produced := p.producedStreams.Load(sid)
+		if pending || produced {
+			p.canceledStreams.Store(sid, struct{}{})
+		}
+		return nil, nil
+	})
+}
@@ -0,0 +1,134 @@
+package gopcp_rpc
+
+import (
+	"context"
+	"github.com/lock-free/gopcp"
+	"github.com/lock-free/gopcp_stream"
+	"testing"
+	"time"
+)
+
+// endless keeps sending until SendData fails, then reports the error
+func cancelSandbox(stopped chan error) GenerateSandbox {
+	return func(streamServer *gopcp_stream.StreamServer) *gopcp.Sandbox {
+		return gopcp.GetSandbox(map[string]*gopcp.BoxFunc{
+			"endless": streamServer.StreamApi(func(streamProducer gopcp_stream.StreamProducer, args []interface{}, attachment interface{}, pcpServer *gopcp.PcpServer) (interface{}, error) {
+				for i := 0; ; i++ {
+					if _, err := streamProducer.SendData(i, 10*time.Second); err != nil {
+						stopped <- err
+						return nil, err
+					}
+					time.Sleep(5 * time.Millisecond)
+				}
+			}),
+		})
+	}
+}
+
+func testCancelClient(t *testing.T, stopped chan error) (*PCPRPCServer, *PCPConnectionHandler) {
+	server, err := GetPCPRPCServer(0, cancelSandbox(stopped), nil)
+	if err != nil {
+		t.Fatalf("fail to start server, %v", err)
+	}
+	client, err := GetPCPRPCClient("127.0.0.1", server.GetPort(), simpleSandbox, nil)
+	if err != nil {
+		t.Fatalf("fail to connect, %v", err)
+	}
+	return server, client
+}
+
+func TestStreamCancel(t *testing.T) {
+	stopped := make(chan error, 1)
+	server, client := testCancelClient(t, stopped)
+	defer server.Close()
+	defer client.Close()
+
+	stream, err := client.Stream(context.Background(), time.Minute, "endless")
+	assertEqual(t, err, nil, "")
+	assertEqual(t, <-stream.C, 0.0, "")
+	assertEqual(t, <-stream.C, 1.0, "")
+
+	stream.Cancel()
+	for range stream.C {
+	}
+	assertEqual(t, stream.Err(), ErrStreamCanceled, "")
+
+	select {
+	case err := <-stopped:
+		assertEqual(t, err, ErrStreamCanceled, "")
+	case <-time.After(5 * time.Second):
+		t.Fatal("producer is not stopped")
+	}
+
+	// producer stopped without end, canceled mark is removed anyway
+	time.Sleep(20 * time.Millisecond)
+	marks := 0
+	for _, p := range server.Connections() {
+		p.canceledStreams.Range(func(_, _ interface{}) bool {
+			marks++
+			return true
+		})
+	}
+	assertEqual(t, marks, 0, "")
+}
+
+func TestCancelStreamCall(t *testing.T) {
+	stopped := make(chan error, 1)
+	server, client := testCancelClient(t, stopped)
+	defer server.Close()
+	defer client.Close()
+
+	chunks := make(chan int, 100)
+	errMsg := make(chan interface{}, 1)
+	sid := client.StreamClient.StreamCallback(func(t int, d interface{}) {
+		if t == gopcp_stream.STREAM_ERROR {
+			errMsg <- d
+		} else {
+			chunks <- t
+		}
+	})
+	cmdText, _ := client.PcpClient.ToJSON(client.PcpClient.Call("endless", sid))
+	go client.CallRemote(cmdText, time.Minute)
+
+	<-chunks
+	assertEqual(t, client.CancelStream(sid, time.Second), nil, "")
+	assertEqual(t, <-errMsg, ErrStreamCanceled.Error(), "")
+
+	select {
+	case err := <-stopped:
+		assertEqual(t, err, ErrStreamCanceled, "")
+	case <-time.After(5 * time.Second):
+		t.Fatal("producer is not stopped")
+	}
+}
+
+func TestStreamContextCanceled(t *testing.T) {
+	stopped := make(chan error, 1)
+	server, client := testCancelClient(t, stopped)
+	defer server.Close()
+	defer client.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stream, err := client.Stream(ctx, time.Minute, "endless")
+	assertEqual(t, err, nil, "")
+	assertEqual(t, <-stream.C, 0.0, "")
+
+	cancel()
+	for range stream.C {
+	}
+	assertEqual(t, stream.Err(), context.Canceled, "")
+
+	// canceled like Stream.Cancel, producer is told and callback is removed
+	select {
+	case err := <-stopped:
+		assertEqual(t, err, ErrStreamCanceled, "")
+	case <-time.After(5 * time.Second):
+		t.Fatal("producer is not stopped")
+	}
+	consumed := 0
+	client.consumedStreams.Range(func(_, _ interface{}) bool {
+		consumed++
+		return true
+	})
+	assertEqual(t, consumed, 0, "")
+}
@@ -0,0 +1,200 @@
+package gopcp_rpc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/lock-free/gopcp_stream"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// credit based flow control of streams
+// producer side: with StreamWindow > 0, stream chunks are pipelined, every chunk without ack takes a credit,
+// producer blocks when credits of the stream are exhausted. Response of stream accept call is the ack.
+// consumer side: stream chunks are dispatched in order per stream, the ack is sent after callback returned,
+// so a slow consumer holds credits of producer.
+
+var ErrStreamWindowTimeout = errors.New("timeout for stream credit, consumer is too slow.")
+
+// credits of a stream at producer side
+type streamCredits struct {
+	sem chan struct{}
+
+	lock sync.Mutex
+	err  error // first failure of pipelined chunks
+}
+
+func (c *streamCredits) fail(err error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.err == nil {
+		c.err = err
+	}
+}
+
+func (c *streamCredits) failure() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.err
+}
+
+// chunks of a stream at consumer side, executed one by one in arriving order
+type streamQueue struct {
+	lock    sync.Mutex
+	tasks   []func()
+	running bool
+}
+
+// returns true when caller should start running the queue
+func (q *streamQueue) push(task func()) bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.tasks = append(q.tasks, task)
+	if q.running {
+		return false
+	}
+	q.running = true
+	return true
+}
+
+func (q *streamQueue) run() {
+	for {
+		q.lock.Lock()
+		if len(q.tasks) == 0 {
+			q.running = false
+			q.lock.Unlock()
+			return
+		}
+		task := q.tasks[0]
+		q.tasks = q.tasks[1:]
+		q.lock.Unlock()
+
+		task()
+	}
+}
+
+// stream id and chunk type of a stream accept command, eg: ["__stream_accept", "sid", 0, data]
+func parseStreamChunk(command string) (string, int, bool) {
+	if !strings.HasPrefix(command, `["`+STREAM_ACCEPT_NAME+`"`) && !strings.HasPrefix(command, `["`+BIDI_ACCEPT_NAME+`"`) {
+		return "", 0, false
+	}
+	var list []json.RawMessage
+	if err := json.Unmarshal([]byte(command), &list); err != nil || len(list) < 3 {
+		return "", 0, false
+	}
+	var sid string
+	var t int
+	if json.Unmarshal(list[1], &sid) != nil || json.Unmarshal(list[2], &t) != nil {
+		return "", 0, false
+	}
+	return sid, t, true
+}
+
+// call function of stream server, sends stream chunks to remote
+func (p *PCPConnectionHandler) sendStreamChunk(command string, timeout time.Duration) (ret interface{}, err error) {
+	window := p.options.StreamWindow
+	sid, t, ok := parseStreamChunk(command)
+	if ok && p.isClosed() {
+		// consumer is gone with the connection
+		return nil, ErrConnectionClosed
+	}
+	if ok && p.isStreamCanceled(sid) {
+		return nil, ErrStreamCanceled
+	}
+	if ok && t == gopcp_stream.STREAM_DATA {
+		p.producedStreams.Store(sid, struct{}{})
+	} else if ok {
+		p.producedStreams.Delete(sid)
+	}
+	defer func() {
+		// producer stops after a failed chunk, stream is not open any more
+		if ok && err != nil {
+			p.producedStreams.Delete(sid)
+		}
+	}()
+	if window <= 0 || !ok {
+		// stream data is not guarded by circuit breaker
+		return p.callRemote(context.Background(), command, timeout)
+	}
+
+	v, _ := p.streamCredits.LoadOrStore(sid, &streamCredits{sem: make(chan struct{}, window)})
+	credits := v.(*streamCredits)
+	if err := credits.failure(); err != nil {
+		return nil, err
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	// take a credit
+	select {
+	case credits.sem <- struct{}{}:
+	case <-p.closed:
+		return nil, ErrConnectionClosed
+	case <-timer.C:
+		return nil, ErrStreamWindowTimeout
+	}
+
+	id, ch, err := p.sendRequest(command)
+	if err != nil {
+		<-credits.sem
+		return nil, err
+	}
+
+	// wait for ack in background, returns the credit
+	go func() {
+		defer atomic.AddInt64(&p.inFlight, -1)
+		if _, err := p.waitResponse(context.Background(), id, ch, command, timeout); err != nil {
+			credits.fail(err)
+		}
+		<-credits.sem
+	}()
+
+	if t == gopcp_stream.STREAM_DATA {
+		return nil, nil
+	}
+
+	// end or error of stream, wait for all chunks acked
+	defer p.streamCredits.Delete(sid)
+	for i := 0; i < window; i++ {
+		select {
+		case credits.sem <- struct{}{}:
+		case <-p.closed:
+			return nil, ErrConnectionClosed
+		case <-timer.C:
+			return nil, ErrStreamWindowTimeout
+		}
+	}
+	return nil, credits.failure()
+}
+
+// dispatch stream chunk from remote in order, returns false when it is not a stream chunk
+func (p *PCPConnectionHandler) dispatchStreamChunk(cmd *CommandPkt, request func()) bool {
+	text, ok := cmd.Data.Text.(string)
+	if !ok {
+		return false
+	}
+	sid, t, ok := parseStreamChunk(text)
+	if !ok {
+		return false
+	}
+
+	v, _ := p.streamQueues.LoadOrStore(sid, &streamQueue{})
+	queue := v.(*streamQueue)
+	if t != gopcp_stream.STREAM_DATA {
+		// no more chunks after end or error
+		p.streamQueues.Delete(sid)
+	}
+
+	atomic.AddInt64(&p.remoteInFlight, 1)
+	if queue.push(func() {
+		request()
+		atomic.AddInt64(&p.remoteInFlight, -1)
+	}) {
+		go queue.run()
+	}
+	return true
+}
@@ -0,0 +1,64 @@
+package gopcp_rpc
+
+import (
+	"context"
+	"github.com/lock-free/gopcp"
+	"github.com/lock-free/gopcp_stream"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParseStreamChunk(t *testing.T) {
+	sid, chunkType, ok := parseStreamChunk(`["__stream_accept","abc",1,0]`)
+	assertEqual(t, ok, true, "")
+	assertEqual(t, sid, "abc", "")
+	assertEqual(t, chunkType, gopcp_stream.STREAM_END, "")
+
+	_, _, ok = parseStreamChunk(`["add",1,2]`)
+	assertEqual(t, ok, false, "")
+}
+
+func TestStreamWindow(t *testing.T) {
+	var produced int64
+	server, err := GetPCPRPCServerWithOptions(0, func(streamServer *gopcp_stream.StreamServer) *gopcp.Sandbox {
+		return gopcp.GetSandbox(map[string]*gopcp.BoxFunc{
+			"produce": streamServer.StreamApi(func(streamProducer gopcp_stream.StreamProducer, args []interface{}, attachment interface{}, pcpServer *gopcp.PcpServer) (interface{}, error) {
+				for i := 0; i < 500; i++ {
+					if _, err := streamProducer.SendData(i, 10*time.Second); err != nil {
+						return nil, err
+					}
+					atomic.AddInt64(&produced, 1)
+				}
+				_, err := streamProducer.SendEnd(10 * time.Second)
+				return nil, err
+			}),
+		})
+	}, nil, ServerOptions{ConnectionOptions: ConnectionOptions{StreamWindow: 4}})
+	if err != nil {
+		t.Fatalf("fail to start server, %v", err)
+	}
+	defer server.Close()
+
+	client, err := GetPCPRPCClient("127.0.0.1", server.GetPort(), simpleSandbox, nil)
+	assertEqual(t, err, nil, "")
+	defer client.Close()
+
+	stream, err := client.Stream(context.Background(), 10*time.Second, "produce")
+	assertEqual(t, err, nil, "")
+
+	// producer is blocked by slow consumer: buffer of stream, one blocked callback and the window
+	time.Sleep(200 * time.Millisecond)
+	if n := atomic.LoadInt64(&produced); n > DEFAULT_STREAM_BUFFER+1+4 {
+		t.Errorf("producer should be blocked, but produced %d", n)
+	}
+
+	// chunks are delivered in order
+	next := 0.0
+	for item := range stream.C {
+		assertEqual(t, item, next, "")
+		next++
+	}
+	assertEqual(t, stream.Err(), nil, "")
+	assertEqual(t, next, 500.0, "")
+}
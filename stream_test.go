@@ -0,0 +1,141 @@
+package gopcp_rpc
+
+import (
+	"context"
+	"github.com/lock-free/gopcp"
+	"github.com/lock-free/gopcp_stream"
+	"testing"
+	"time"
+)
+
+// count sends 1..n then ends, fail sends an error, forever keeps sending
+func streamSandbox(streamServer *gopcp_stream.StreamServer) *gopcp.Sandbox {
+	return gopcp.GetSandbox(map[string]*gopcp.BoxFunc{
+		"count": streamServer.StreamApi(func(streamProducer gopcp_stream.StreamProducer, args []interface{}, attachment interface{}, pcpServer *gopcp.PcpServer) (interface{}, error) {
+			for i := 1; i <= int(args[0].(float64)); i++ {
+				streamProducer.SendData(i, 10*time.Second)
+			}
+			streamProducer.SendEnd(10 * time.Second)
+			return nil, nil
+		}),
+		"fail": streamServer.StreamApi(func(streamProducer gopcp_stream.StreamProducer, args []interface{}, attachment interface{}, pcpServer *gopcp.PcpServer) (interface{}, error) {
+			streamProducer.SendData(1, 10*time.Second)
+			streamProducer.SendError("broken producer", 10*time.Second)
+			return nil, nil
+		}),
+		"forever": streamServer.LazyStreamApi(func(streamProducer gopcp_stream.StreamProducer, args []interface{}, attachment interface{}, pcpServer *gopcp.PcpServer) (interface{}, error) {
+			for i := 0; ; i++ {
+				if _, err := streamProducer.SendData(i, 10*time.Second); err != nil {
+					return nil, err
+				}
+				time.Sleep(5 * time.Millisecond)
+			}
+		}),
+	})
+}
+
+func testStreamClient(t *testing.T) (*PCPRPCServer, *PCPConnectionHandler) {
+	server, err := GetPCPRPCServer(0, streamSandbox, nil)
+	if err != nil {
+		t.Fatalf("fail to start server, %v", err)
+	}
+	client, err := GetPCPRPCClient("127.0.0.1", server.GetPort(), simpleSandbox, nil)
+	if err != nil {
+		t.Fatalf("fail to connect, %v", err)
+	}
+	return server, client
+}
+
+func TestStreamChannel(t *testing.T) {
+	server, client := testStreamClient(t)
+	defer server.Close()
+	defer client.Close()
+
+	stream, err := client.Stream(context.Background(), 10*time.Second, "count", 100)
+	assertEqual(t, err, nil, "")
+	sum := 0.0
+	for item := range stream.C {
+		sum += item.(float64)
+	}
+	assertEqual(t, stream.Err(), nil, "")
+	assertEqual(t, sum, 5050.0, "")
+
+	stream, err = client.Stream(context.Background(), 10*time.Second, "fail")
+	assertEqual(t, err, nil, "")
+	count := 0
+	for range stream.C {
+		count++
+	}
+	assertEqual(t, count, 1, "")
+	assertEqual(t, stream.Err().Error(), "broken producer", "")
+}
+
+func TestStreamChannelCancel(t *testing.T) {
+	server, client := testStreamClient(t)
+	defer server.Close()
+	defer client.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream, err := client.Stream(ctx, 10*time.Second, "forever")
+	assertEqual(t, err, nil, "")
+
+	count := 0
+	for range stream.C {
+		count++
+		if count == 3 {
+			cancel()
+		}
+	}
+	assertEqual(t, stream.Err(), context.Canceled, "")
+}
+
+func TestStreamClientDisconnect(t *testing.T) {
+	stopped := make(chan error, 1)
+	server, client := testCancelClient(t, stopped)
+	defer server.Close()
+
+	stream, err := client.Stream(context.Background(), time.Minute, "endless")
+	assertEqual(t, err, nil, "")
+	<-stream.C
+
+	client.Close()
+	for range stream.C {
+	}
+	assertEqual(t, stream.Err(), ErrConnectionClosed, "")
+
+	select {
+	case err := <-stopped:
+		assertEqual(t, err, ErrConnectionClosed, "")
+	case <-time.After(5 * time.Second):
+		t.Fatal("producer is not stopped")
+	}
+}
+
+func TestStreamServerDisconnect(t *testing.T) {
+	stopped := make(chan error, 1)
+	server, client := testCancelClient(t, stopped)
+	defer client.Close()
+
+	errMsg := make(chan interface{}, 1)
+	exp, err := client.StreamCall("endless", gopcp_stream.StreamCallbackFunc(func(t int, d interface{}) {
+		if t == gopcp_stream.STREAM_ERROR {
+			errMsg <- d
+		}
+	}))
+	assertEqual(t, err, nil, "")
+	go client.Call(*exp, time.Minute)
+	time.Sleep(20 * time.Millisecond)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	server.Shutdown(ctx)
+
+	assertEqual(t, <-errMsg, ErrConnectionClosed.Error(), "")
+	select {
+	case err := <-stopped:
+		assertEqual(t, err, ErrConnectionClosed, "")
+	case <-time.After(5 * time.Second):
+		t.Fatal("producer is not stopped")
+	}
+}
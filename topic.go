@@ -0,0 +1,206 @@
+package gopcp_rpc
+
+import (
+	"context"
+	"errors"
+	"github.com/lock-free/gopcp"
+	"github.com/lock-free/gopcp_stream"
+	"sync"
+	"time"
+)
+
+// pub/sub topics
+// clients subscribe by the default "__subscribe" stream function, server publishes messages to topics.
+// every subscriber has its own buffer, when it is full, message is handled by the drop policy of subscriber.
+// eg:
+//   stream, err := client.Subscribe(ctx, time.Hour, "news", rpc.SubscribeOptions{Buffer: 64, Policy: rpc.TOPIC_DROP_OLDEST})
+//   server.Publish("news", "hello")
+
+type DropPolicy int
+
+const (
+	// drop the message being published
+	TOPIC_DROP_NEWEST DropPolicy = iota
+	// drop the oldest message in buffer
+	TOPIC_DROP_OLDEST
+	// end the subscription with ErrSubscriberTooSlow
+	TOPIC_CLOSE_SLOW
+)
+
+const DEFAULT_TOPIC_BUFFER = 256
+
+// buffer of a subscription asked by remote is capped at it
+const MAX_TOPIC_BUFFER = 4096
+const DEFAULT_TOPIC_SEND_TIMEOUT = 10 * time.Second
+
+var ErrSubscriberTooSlow = errors.New("subscriber is too slow, buffer of subscription is full.")
+var ErrTopicsDisabled = errors.New("topics are not supported at remote.")
+var ErrBadSubscribeBuffer = errors.New("buffer of subscription should not be negative.")
+var ErrBadDropPolicy = errors.New("unknown drop policy of subscription.")
+
+type SubscribeOptions struct {
+	// messages buffered for subscriber, default is DEFAULT_TOPIC_BUFFER, at most MAX_TOPIC_BUFFER
+	Buffer int
+	Policy DropPolicy
+}
+
+type subscription struct {
+	ch     chan interface{}
+	policy DropPolicy
+
+	lock   sync.Mutex // guards offering to ch
+	once   sync.Once
+	closed chan struct{}
+}
+
+func (s *subscription) offer(message interface{}) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	select {
+	case s.ch <- message:
+		return true
+	default:
+	}
+
+	switch s.policy {
+	case TOPIC_DROP_OLDEST:
+		select {
+		case <-s.ch:
+		default:
+		}
+		s.ch <- message
+		return true
+	case TOPIC_CLOSE_SLOW:
+		s.once.Do(func() {
+			close(s.closed)
+		})
+		return false
+	default:
+		return false
+	}
+}
+
+type TopicBroker struct {
+	lock   sync.RWMutex
+	topics map[string]map[*subscription]struct{}
+}
+
+func GetTopicBroker() *TopicBroker {
+	return &TopicBroker{topics: map[string]map[*subscription]struct{}{}}
+}
+
+// returns number of subscribers which got the message in buffer
+func (b *TopicBroker) Publish(topic string, message interface{}) int {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	n := 0
+	for sub := range b.topics[topic] {
+		if sub.offer(message) {
+			n++
+		}
+	}
+	return n
+}
+
+func (b *TopicBroker) Subscribers(topic string) int {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	return len(b.topics[topic])
+}
+
+func (b *TopicBroker) subscribe(topic string, options SubscribeOptions) *subscription {
+	if options.Buffer <= 0 {
+		options.Buffer = DEFAULT_TOPIC_BUFFER
+	}
+	sub := &subscription{
+		ch:     make(chan interface{}, options.Buffer),
+		policy: options.Policy,
+		closed: make(chan struct{}),
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if _, ok := b.topics[topic]; !ok {
+		b.topics[topic] = map[*subscription]struct{}{}
+	}
+	b.topics[topic][sub] = struct{}{}
+	return sub
+}
+
+func (b *TopicBroker) unsubscribe(topic string, sub *subscription) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	delete(b.topics[topic], sub)
+	if len(b.topics[topic]) == 0 {
+		delete(b.topics, topic)
+	}
+}
+
+// subscribe topic of remote, messages are received from stream.C.
+// subscription ends when ctx is done, stream is canceled or timeout.
+func (p *PCPConnectionHandler) Subscribe(ctx context.Context, timeout time.Duration, topic string, options SubscribeOptions) (*Stream, error) {
+	stream, _, err := p.startStream(ctx, timeout, SUBSCRIBE_NAME, []interface{}{topic, options.Buffer, int(options.Policy)}, nil)
+	return stream, err
+}
+
+// args = [topic: string, buffer: int, policy: int, streamId: string]
+func getSubscribeBoxFun(streamServer *gopcp_stream.StreamServer) *gopcp.BoxFunc {
+	return streamServer.StreamApi(func(streamProducer gopcp_stream.StreamProducer, args []interface{}, attachment interface{}, pcpServer *gopcp.PcpServer) (interface{}, error) {
+		if len(args) < 3 {
+			return nil, errors.New("subscribe format: [topic: string, buffer: int, policy: int].")
+		}
+		topic, ok := args[0].(string)
+		if !ok {
+			return nil, errors.New("subscribe format: [topic: string, buffer: int, policy: int].")
+		}
+		buffer, _ := args[1].(float64)
+		policy, _ := args[2].(float64)
+		if buffer < 0 {
+			return nil, ErrBadSubscribeBuffer
+		} else if buffer > MAX_TOPIC_BUFFER {
+			buffer = MAX_TOPIC_BUFFER
+		}
+		if policy != float64(TOPIC_DROP_NEWEST) && policy != float64(TOPIC_DROP_OLDEST) && policy != float64(TOPIC_CLOSE_SLOW) {
+			return nil, ErrBadDropPolicy
+		}
+
+		p, ok := getConnectionHandler(attachment)
+		if !ok || p.topics == nil {
+			return nil, ErrTopicsDisabled
+		}
+
+		sub := p.topics.subscribe(topic, SubscribeOptions{int(buffer), DropPolicy(policy)})
+		defer p.topics.unsubscribe(topic, sub)
+
+		// ends when subscriber canceled, or connection closed
+		ctx := GetContext(attachment)
+		for {
+			select {
+			case message := <-sub.ch:
+				if _, err := streamProducer.SendData(message, DEFAULT_TOPIC_SEND_TIMEOUT); err != nil {
+					return nil, err
+				}
+			case <-sub.closed:
+				streamProducer.SendError(ErrSubscriberTooSlow.Error(), DEFAULT_TOPIC_SEND_TIMEOUT)
+				return nil, ErrSubscriberTooSlow
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-p.draining:
+				// subscription never ends by itself, it would block draining
+				streamProducer.SendError(ErrGoingAway.Error(), DEFAULT_TOPIC_SEND_TIMEOUT)
+				return nil, ErrGoingAway
+			}
+		}
+	})
+}
+
+func (s *PCPRPCServer) Topics() *TopicBroker {
+	return s.topics
+}
+
+// publish message to subscribers of topic, returns number of subscribers which got it
+func (s *PCPRPCServer) Publish(topic string, message interface{}) int {
+	return s.topics.Publish(topic, message)
+}
@@ -0,0 +1,174 @@
+package gopcp_rpc
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestTopicDropPolicy(t *testing.T) {
+	broker := GetTopicBroker()
+	newest := broker.subscribe("t", SubscribeOptions{2, TOPIC_DROP_NEWEST})
+	oldest := broker.subscribe("t", SubscribeOptions{2, TOPIC_DROP_OLDEST})
+	slow := broker.subscribe("t", SubscribeOptions{2, TOPIC_CLOSE_SLOW})
+	assertEqual(t, broker.Subscribers("t"), 3, "")
+
+	assertEqual(t, broker.Publish("t", 1), 3, "")
+	assertEqual(t, broker.Publish("t", 2), 3, "")
+	assertEqual(t, broker.Publish("t", 3), 1, "")
+
+	assertEqual(t, <-newest.ch, 1, "")
+	assertEqual(t, <-newest.ch, 2, "")
+	assertEqual(t, <-oldest.ch, 2, "")
+	assertEqual(t, <-oldest.ch, 3, "")
+	select {
+	case <-slow.closed:
+	default:
+		t.Fatal("slow subscriber is not closed")
+	}
+
+	broker.unsubscribe("t", newest)
+	broker.unsubscribe("t", oldest)
+	broker.unsubscribe("t", slow)
+	assertEqual(t, broker.Subscribers("t"), 0, "")
+}
+
+func waitSubscribers(t *testing.T, server *PCPRPCServer, topic string, n int) {
+	for i := 0; server.Topics().Subscribers(topic) != n; i++ {
+		if i > 100 {
+			t.Fatalf("expect %d subscribers of %s", n, topic)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	server, err := GetPCPRPCServer(0, simpleSandbox, nil)
+	if err != nil {
+		t.Fatalf("fail to start server, %v", err)
+	}
+	defer server.Close()
+	client, err := GetPCPRPCClient("127.0.0.1", server.GetPort(), simpleSandbox, nil)
+	assertEqual(t, err, nil, "")
+	defer client.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream, err := client.Subscribe(ctx, time.Minute, "news", SubscribeOptions{})
+	assertEqual(t, err, nil, "")
+	waitSubscribers(t, server, "news", 1)
+
+	for i := 1; i <= 5; i++ {
+		assertEqual(t, server.Publish("news", i), 1, "")
+	}
+	for i := 1; i <= 5; i++ {
+		assertEqual(t, <-stream.C, float64(i), "")
+	}
+
+	cancel()
+	for range stream.C {
+	}
+	assertEqual(t, stream.Err(), context.Canceled, "")
+	waitSubscribers(t, server, "news", 0)
+}
+
+func TestSubscribeAtClient(t *testing.T) {
+	server, err := GetPCPRPCServer(0, simpleSandbox, nil)
+	if err != nil {
+		t.Fatalf("fail to start server, %v", err)
+	}
+	defer server.Close()
+	client, err := GetPCPRPCClient("127.0.0.1", server.GetPort(), simpleSandbox, nil)
+	assertEqual(t, err, nil, "")
+	defer client.Close()
+
+	// server side subscribes topics of client
+	waitConnections := func() *PCPConnectionHandler {
+		for len(server.Connections()) == 0 {
+			time.Sleep(10 * time.Millisecond)
+		}
+		return server.Connections()[0]
+	}
+	stream, err := waitConnections().Subscribe(context.Background(), time.Minute, "news", SubscribeOptions{})
+	assertEqual(t, err, nil, "")
+	for range stream.C {
+	}
+	assertEqual(t, stream.Err().(*CallError).ErrMsg, ErrTopicsDisabled.Error(), "")
+}
+
+// requests are sent in one write, so they are handled in one read. Returns responses in order of arriving.
+func requestsOfSameRead(t *testing.T, port int, exps ...string) (<-chan *CommandPkt, func()) {
+	conn, err := net.Dial("tcp", "127.0.0.1:"+strconv.Itoa(port))
+	assertEqual(t, err, nil, "")
+
+	var chunk []byte
+	for i, exp := range exps {
+		text, err := commandToText(CommandPkt{strconv.Itoa(i + 1), REQUEST_C_TYPE, CommandData{exp, 0, ""}})
+		assertEqual(t, err, nil, "")
+		chunk = append(chunk, TextToPkt(text)...)
+	}
+	_, err = conn.Write(chunk)
+	assertEqual(t, err, nil, "")
+
+	responses := make(chan *CommandPkt, 10)
+	go func() {
+		defer close(responses)
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		packageProtocol := GetPackageProtocol()
+		buf := make([]byte, 1024)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				return
+			}
+			for _, text := range packageProtocol.GetPktText(buf[:n]) {
+				if cmd, err := stringToCommand(text); err == nil && cmd.Ctype == RESPONSE_C_TYPE {
+					responses <- cmd
+				}
+			}
+		}
+	}()
+	return responses, func() { conn.Close() }
+}
+
+func TestSubscribeNotBlockingRequestsOfSameRead(t *testing.T) {
+	server, err := GetPCPRPCServer(0, simpleSandbox, nil)
+	if err != nil {
+		t.Fatalf("fail to start server, %v", err)
+	}
+	defer server.Close()
+
+	// subscription stays open, add is answered anyway
+	responses, closeConn := requestsOfSameRead(t, server.GetPort(), `["__subscribe", "news", 0, 0, "sid"]`, `["add", 1, 2]`)
+	defer closeConn()
+	cmd, ok := <-responses
+	if !ok {
+		t.Fatalf("add is not answered")
+	}
+	assertEqual(t, cmd.Id, "2", "")
+	assertEqual(t, cmd.Data.Text, float64(3), "")
+}
+
+func TestRequestsOfSameReadInOrder(t *testing.T) {
+	server, err := GetPCPRPCServer(0, simpleSandbox, nil)
+	if err != nil {
+		t.Fatalf("fail to start server, %v", err)
+	}
+	defer server.Close()
+
+	// requests which are not streams are executed in order, slower one first
+	responses, closeConn := requestsOfSameRead(t, server.GetPort(), `["testSleep"]`, `["add", 1, 2]`)
+	defer closeConn()
+	var ids []string
+	for cmd := range responses {
+		ids = append(ids, cmd.Id)
+		if len(ids) == 2 {
+			break
+		}
+	}
+	assertEqual(t, len(ids), 2, "")
+	assertEqual(t, ids[0], "1", "")
+	assertEqual(t, ids[1], "2", "")
+}
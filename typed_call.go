@@ -0,0 +1,115 @@
+package gopcp_rpc
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/lock-free/gopcp"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// typed calls
+// result text of response is decoded into a go value by encoding/json, instead of interface{} of map and float64.
+// eg:
+//   user, err := rpc.CallTyped[User](ctx, pool, p.Call("getUser", 1), time.Second)
+//   err = client.CallInto(ctx, p.Call("getUser", 1), time.Second, &user)
+
+// PCPConnectionHandler, PCPRPCPool and BalancedClient
+type ContextCaller interface {
+	CallContext(ctx context.Context, list gopcp.CallResult, timeout time.Duration) (interface{}, error)
+}
+
+// result of call could not be decoded into the target type
+type ResultDecodeError struct {
+	Type string // go type of target
+	Text string // json text of result
+	Err  error
+}
+
+func (e *ResultDecodeError) Error() string {
+	text := e.Text
+	if len(text) > 256 {
+		text = text[:256] + "..."
+	}
+	return "fail to decode result into " + e.Type + ": " + e.Err.Error() + ". result=" + text
+}
+
+func (e *ResultDecodeError) Unwrap() error {
+	return e.Err
+}
+
+type resultTextKey struct{}
+
+// keeps response text of the first successful call, hedged or retried calls may respond more than once
+type resultText struct {
+	lock sync.Mutex
+	text string
+	ok   bool
+}
+
+func setResultText(ctx context.Context, text string) {
+	if r, ok := ctx.Value(resultTextKey{}).(*resultText); ok && text != "" {
+		r.lock.Lock()
+		defer r.lock.Unlock()
+		if !r.ok {
+			r.text = text
+			r.ok = true
+		}
+	}
+}
+
+// json text of result, from response text when it is captured
+func (r *resultText) result(ret interface{}) (json.RawMessage, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.ok {
+		var pkt struct {
+			Data struct {
+				Text json.RawMessage `json:"text"`
+			} `json:"data"`
+		}
+		if err := json.Unmarshal([]byte(r.text), &pkt); err == nil {
+			return pkt.Data.Text, nil
+		}
+	}
+	return json.Marshal(ret)
+}
+
+// call and decode result into out, which should be a non-nil pointer
+func CallInto(ctx context.Context, caller ContextCaller, list gopcp.CallResult, timeout time.Duration, out interface{}) error {
+	r := &resultText{}
+	ret, err := caller.CallContext(context.WithValue(ctx, resultTextKey{}, r), list, timeout)
+	if err != nil {
+		return err
+	}
+
+	text, err := r.result(ret)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(text, out); err != nil {
+		return &ResultDecodeError{reflect.TypeOf(out).String(), string(text), err}
+	}
+	return nil
+}
+
+// call and decode result into T
+func CallTyped[T any](ctx context.Context, caller ContextCaller, list gopcp.CallResult, timeout time.Duration) (T, error) {
+	var out T
+	err := CallInto(ctx, caller, list, timeout, &out)
+	return out, err
+}
+
+func (p *PCPConnectionHandler) CallInto(ctx context.Context, list gopcp.CallResult, timeout time.Duration, out interface{}) error {
+	return CallInto(ctx, p, list, timeout, out)
+}
+
+func (p *PCPRPCPool) CallInto(ctx context.Context, list gopcp.CallResult, timeout time.Duration, out interface{}) error {
+	return CallInto(ctx, p, list, timeout, out)
+}
+
+func (b *BalancedClient) CallInto(ctx context.Context, list gopcp.CallResult, timeout time.Duration, out interface{}) error {
+	return CallInto(ctx, b, list, timeout, out)
+}
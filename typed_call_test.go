@@ -0,0 +1,76 @@
+package gopcp_rpc
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/lock-free/gopcp"
+	"github.com/lock-free/gopcp_stream"
+	"testing"
+	"time"
+)
+
+type typedUser struct {
+	Id   int64    `json:"id"`
+	Name string   `json:"name"`
+	Tags []string `json:"tags"`
+}
+
+func typedSandbox(streamServer *gopcp_stream.StreamServer) *gopcp.Sandbox {
+	return gopcp.GetSandbox(map[string]*gopcp.BoxFunc{
+		"getUser": gopcp.ToSandboxFun(func(args []interface{}, attachment interface{}, pcpServer *gopcp.PcpServer) (interface{}, error) {
+			// larger than max safe integer of float64
+			return map[string]interface{}{"id": int64(9007199254740993), "name": "alice", "tags": []string{"a", "b"}}, nil
+		}),
+	})
+}
+
+func TestCallTyped(t *testing.T) {
+	server, err := GetPCPRPCServer(0, typedSandbox, nil)
+	if err != nil {
+		t.Fatalf("fail to start server, %v", err)
+	}
+	defer server.Close()
+	client, err := GetPCPRPCClient("127.0.0.1", server.GetPort(), simpleSandbox, nil)
+	assertEqual(t, err, nil, "")
+	defer client.Close()
+
+	p := gopcp.PcpClient{}
+	user, err := CallTyped[typedUser](context.Background(), client, p.Call("getUser"), time.Second)
+	assertEqual(t, err, nil, "")
+	assertEqual(t, user.Id, int64(9007199254740993), "")
+	assertEqual(t, user.Name, "alice", "")
+	assertEqual(t, len(user.Tags), 2, "")
+
+	// name is not a number
+	var name struct {
+		Name int `json:"name"`
+	}
+	err = client.CallInto(context.Background(), p.Call("getUser"), time.Second, &name)
+	decodeErr, ok := err.(*ResultDecodeError)
+	assertEqual(t, ok, true, "")
+	assertEqual(t, decodeErr.Err.(*json.UnmarshalTypeError).Field, "name", "")
+
+	// call errors are returned as they are
+	_, err = CallTyped[typedUser](context.Background(), client, p.Call("missing"), time.Second)
+	_, ok = err.(*CallError)
+	assertEqual(t, ok, true, "")
+}
+
+func TestPoolCallTyped(t *testing.T) {
+	server, err := GetPCPRPCServer(0, typedSandbox, nil)
+	if err != nil {
+		t.Fatalf("fail to start server, %v", err)
+	}
+	defer server.Close()
+
+	pool := GetPCPRPCPool(func() (string, int, error) {
+		return "127.0.0.1", server.GetPort(), nil
+	}, simpleSandbox, 2, 10*time.Millisecond, 10*time.Millisecond)
+	defer pool.Shutdown()
+	time.Sleep(50 * time.Millisecond)
+
+	p := gopcp.PcpClient{}
+	var user typedUser
+	assertEqual(t, pool.CallInto(context.Background(), p.Call("getUser"), time.Second, &user), nil, "")
+	assertEqual(t, user.Id, int64(9007199254740993), "")
+}